@@ -1,63 +1,1079 @@
 import os
+import io
+import csv
+import html
 import logging
 import json
+import re
 import asyncio
+import ipaddress
+import secrets
+import smtplib
+import signal
+import threading
+import time
+from abc import ABC, abstractmethod
+from collections import deque
+from dataclasses import dataclass, field
+import sqlite3
 import requests
+import yaml
+from requests.adapters import HTTPAdapter
+import dns.asyncresolver
+import dns.exception
+from datetime import datetime, time as dt_time, timedelta, timezone
+from email.message import EmailMessage
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
 from pathlib import Path
-from telegram import Update
-from telegram.ext import Application, CommandHandler, ContextTypes, JobQueue
+from string import Template
+from types import SimpleNamespace
+from urllib.parse import urlparse
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+from apscheduler.triggers.cron import CronTrigger
+from prometheus_client import Counter, Gauge, Histogram, start_http_server
+from telegram import InlineKeyboardButton, InlineKeyboardMarkup, Update
+from telegram.error import BadRequest, Forbidden, NetworkError, RetryAfter
+from telegram.ext import (
+    Application, ApplicationBuilder, ApplicationHandlerStop, CallbackQueryHandler, CommandHandler, ContextTypes,
+    JobQueue, MessageHandler, TypeHandler, filters,
+)
 
 # --- Configuration & Logging (No changes) ---
+def env_flag(name: str, default: bool = False) -> bool:
+    """Reads a boolean env var, accepting 1/true/yes/on (case-insensitive) as true."""
+    raw = os.getenv(name)
+    if raw is None or not raw.strip(): return default
+    return raw.strip().lower() in ("1", "true", "yes", "on")
+
+# Optional YAML file of settings, keyed by env var name (case-insensitive):
+#   CHECK_SCHEDULE: 15m
+#   ADMIN_CHAT_ID: [12345, 67890]
+# Real env vars override the file. Problems are reported with the rest of the config at startup.
+CONFIG_FILE = Path(os.getenv("CONFIG_FILE", "config.yaml"))
+config_file_keys: set[str] = set()  # settings taken from the file
+config_file_error: str | None = None
+
+def read_config_file(path: Path) -> dict[str, str]:
+    """Parses the config file into env-style strings. Lists become comma-separated, booleans true/false.
+
+    Raises ValueError if the file can't be read or isn't a mapping of settings.
+    """
+    try:
+        data = yaml.safe_load(path.read_text(encoding="utf-8"))
+    except (OSError, UnicodeDecodeError, yaml.YAMLError) as e:
+        raise ValueError(f"could not read {path}: {e}")
+    if data is None: return {}
+    if not isinstance(data, dict): raise ValueError(f"{path} must be a mapping of SETTING: value")
+    settings = {}
+    for key, value in data.items():
+        if value is None: continue
+        if isinstance(value, dict): raise ValueError(f"{key}: nested sections are not supported")
+        if isinstance(value, list): value = ",".join(str(v) for v in value)
+        elif isinstance(value, bool): value = "true" if value else "false"
+        settings[str(key).upper()] = str(value)
+    return settings
+
+def apply_config_file() -> None:
+    """Fills env vars that aren't set from CONFIG_FILE, if it exists."""
+    global config_file_error
+    if not CONFIG_FILE.exists():
+        if "CONFIG_FILE" in os.environ: config_file_error = f"CONFIG_FILE '{CONFIG_FILE}' does not exist."
+        return
+    try:
+        settings = read_config_file(CONFIG_FILE)
+    except ValueError as e:
+        config_file_error = f"CONFIG_FILE: {e}"
+        return
+    for key, value in settings.items():
+        if key in os.environ: continue
+        os.environ[key] = value
+        config_file_keys.add(key)
+
+apply_config_file()
+
 TELEGRAM_TOKEN = os.getenv("TELEGRAM_TOKEN")
+# Runs a single check without Telegram, printing messages to stdout instead of sending them.
+DRY_RUN = env_flag("DRY_RUN")
 INDIWTF_TOKEN = os.getenv("INDIWTF_TOKEN")
-INDIWTF_API_BASE_URL = "https://indiwtf.com/api"
+INDIWTF_API_BASE_URL = os.getenv("API_BASE_URL", "https://indiwtf.com/api")
+CHECK_BACKEND = os.getenv("CHECK_BACKEND", "indiwtf").lower()
+# "GET" (default) puts the domain in the query string; "POST" sends it as a form body instead.
+API_METHOD = os.getenv("API_METHOD", "GET").upper()
+# Proxies, e.g. "http://proxy:3128" or "socks5://proxy:1080". Without them both clients still
+# honor the standard HTTP_PROXY / HTTPS_PROXY / NO_PROXY variables.
+API_PROXY = os.getenv("API_PROXY")  # indiwtf API requests only
+TELEGRAM_PROXY = os.getenv("TELEGRAM_PROXY")  # Telegram Bot API requests only
+# Comma-separated chat IDs allowed to use the bot. When unset, the chat that sent /start receives reports.
+ADMIN_CHAT_ID = os.getenv("ADMIN_CHAT_ID")
+# Comma-separated chat IDs with read-only access (/list, /status, /check, ...). Requires ADMIN_CHAT_ID.
+VIEWER_CHAT_IDS = os.getenv("VIEWER_CHAT_IDS")
+DB_FILE = Path("domains.db")
+# Legacy flat files, imported into the database once on startup.
 DATA_FILE = Path("domains.json")
-PERIODIC_CHECK_INTERVAL = 30 * 60
+STATUS_FILE = Path("status.json")
+BACKUP_DIR = Path("backups")
+# Optional directory of <name>.txt files; each file's domains are imported with the tag #<name>.
+DOMAINS_DIR = os.getenv("DOMAINS_DIR")
+BACKUP_KEEP = os.getenv("BACKUP_KEEP", "0")  # snapshots kept in BACKUP_DIR by /backup; 0 keeps none
+# Full report of every global scheduled check, written as report-YYYYMMDD-HHMMSS.txt for auditing.
+REPORT_DIR = Path(os.getenv("REPORT_DIR", "reports"))
+REPORT_KEEP = os.getenv("REPORT_KEEP", "0")  # reports kept in REPORT_DIR; 0 disables writing them
+# Either a plain duration like "15m"/"1h30m" or a 5-field cron expression (UTC).
+CHECK_SCHEDULE = os.getenv("CHECK_SCHEDULE", "30m")
+# API requests in flight at once. The API takes one domain per request, so this, not a batch
+# size, sets the load on it; values above the ceiling are clamped to spare the public API.
+MAX_CHECK_CONCURRENCY = 30
+CHECK_CONCURRENCY = os.getenv("CHECK_CONCURRENCY", "4")
+# Minimum spacing between API requests across all workers: "500ms", "1s", or plain milliseconds.
+API_DELAY = os.getenv("API_DELAY", "500ms")
+# Per-request timeout and the deadline for a whole watchlist check, same format as API_DELAY.
+HTTP_TIMEOUT = os.getenv("HTTP_TIMEOUT", "10s")
+CHECK_DEADLINE = os.getenv("CHECK_DEADLINE", "600s")
+API_MAX_ATTEMPTS = 4  # the first request plus up to 3 retries, 1s, 2s and 4s apart
+API_RETRY_BASE_DELAY = 1  # seconds, doubled after every failed attempt
+SEND_MAX_ATTEMPTS = 3
+SEND_RETRY_BASE_DELAY = 1  # seconds, doubled after every failed attempt
+UNDELIVERED_LIMIT = 50  # notifications kept for redelivery on the next check
+# Telegram's per-chat limits; sends beyond them wait their turn instead of hitting 429s.
+SEND_MIN_INTERVAL = 1.0  # seconds between messages to one chat
+SEND_PER_MINUTE = 20  # messages per chat in any 60 seconds
+# Resolvers queried by /dns as comma-separated name=IP pairs; the host's own resolver
+# (usually the ISP's) is always queried as "system".
+DNS_RESOLVERS = os.getenv("DNS_RESOLVERS", "Google=8.8.8.8,Cloudflare=1.1.1.1,Quad9=9.9.9.9")
+DNS_TIMEOUT = 5  # seconds per resolver
+# Registration expiry warnings via RDAP; off unless EXPIRY_WARN_DAYS is set, e.g. to 30.
+EXPIRY_WARN_DAYS = os.getenv("EXPIRY_WARN_DAYS", "0")
+EXPIRY_CHECK_INTERVAL = os.getenv("EXPIRY_CHECK_INTERVAL", "1d")
+RDAP_BASE_URL = os.getenv("RDAP_BASE_URL", "https://rdap.org").rstrip("/")
+RDAP_DELAY = 1  # seconds between RDAP lookups in the background expiry check
+RDAP_CACHE_TTL = 6 * 3600  # seconds an RDAP answer (including "no data") is reused
+TZ_DISPLAY = os.getenv("TZ_DISPLAY", "UTC")
+# Window in TZ_DISPLAY time, e.g. "22:00-07:00", in which notifications are held and sent as
+# one summary when it ends. QUIET_ALLOW_BLOCKED lets newly-blocked alerts through anyway.
+QUIET_HOURS = os.getenv("QUIET_HOURS")
+QUIET_ALLOW_BLOCKED = env_flag("QUIET_ALLOW_BLOCKED")
+# Set to false for sinks that render emoji poorly; statuses become "[BLOCKED]" / "[OK]".
+USE_EMOJI = env_flag("USE_EMOJI", True)
+# "polling" (default) or "webhook". Webhook mode needs WEBHOOK_URL; TLS cert/key are optional
+# for deployments where a load balancer terminates HTTPS.
+BOT_MODE = os.getenv("BOT_MODE", "polling").lower()
+WEBHOOK_URL = os.getenv("WEBHOOK_URL")
+WEBHOOK_LISTEN = os.getenv("WEBHOOK_LISTEN", "0.0.0.0")
+WEBHOOK_PORT = os.getenv("WEBHOOK_PORT", "8443")
+WEBHOOK_SECRET = os.getenv("WEBHOOK_SECRET")
+WEBHOOK_CERT = os.getenv("WEBHOOK_CERT")
+WEBHOOK_KEY = os.getenv("WEBHOOK_KEY")
+NOTIFY_UNBLOCKED = env_flag("NOTIFY_UNBLOCKED", True)
+# Comma-separated sinks for reports and alerts: "telegram" (default), "slack" and/or "email".
+NOTIFIER = os.getenv("NOTIFIER", "telegram")
+SLACK_WEBHOOK_URL = os.getenv("SLACK_WEBHOOK_URL")  # Slack incoming webhook, required for NOTIFIER=slack
+# SMTP server for emailed reports (scheduled runs and /emailreport) and NOTIFIER=email; off without SMTP_HOST.
+SMTP_HOST = os.getenv("SMTP_HOST")
+SMTP_PORT = os.getenv("SMTP_PORT", "587")
+SMTP_SECURITY = os.getenv("SMTP_SECURITY", "starttls").lower()  # "starttls", "ssl" or "none"
+SMTP_USER = os.getenv("SMTP_USER")
+SMTP_PASSWORD = os.getenv("SMTP_PASSWORD")
+SMTP_FROM = os.getenv("SMTP_FROM")
+SMTP_TO = os.getenv("SMTP_TO")  # comma-separated recipients
+EMAIL_HTML = env_flag("EMAIL_HTML")  # add an HTML part next to the plain-text report
+EMAIL_SCHEDULED = env_flag("EMAIL_SCHEDULED", True)  # email the report of every global scheduled run
+# URL that receives a JSON POST for every status change (domain, old/new status, timestamp),
+# independent of Telegram notifications and NOTIFY_COOLDOWN. Not to be confused with WEBHOOK_URL.
+STATUS_WEBHOOK_URL = os.getenv("STATUS_WEBHOOK_URL")
+STATUS_WEBHOOK_ATTEMPTS = 4  # also used for Slack posts
+STATUS_WEBHOOK_RETRY_BASE_DELAY = 2  # seconds, doubled after every failed attempt
+# Forum topic that notifications are posted to in group chats; private chats have no topics.
+MESSAGE_THREAD_ID = os.getenv("MESSAGE_THREAD_ID")
+# Keep one pinned report per chat up to date after every scheduled check, edited in place.
+DASHBOARD = env_flag("DASHBOARD")
+# Minimum time between status notifications for the same domain, e.g. "6h"; "0s" disables it.
+NOTIFY_COOLDOWN = os.getenv("NOTIFY_COOLDOWN", "0s")
+# string.Template for the /checknow report, inline or read from a file; the built-in layout is used when unset.
+REPORT_TEMPLATE = os.getenv("REPORT_TEMPLATE")
+REPORT_TEMPLATE_FILE = os.getenv("REPORT_TEMPLATE_FILE")
+# How long a result is reused by manual checks before the API is queried again; "0s" disables caching.
+RESULT_CACHE_TTL = os.getenv("RESULT_CACHE_TTL", "60s")
+METRICS_PORT = os.getenv("METRICS_PORT")  # metrics endpoint is disabled when unset
+HEALTH_PORT = os.getenv("HEALTH_PORT")  # /healthz and /readyz are disabled when unset
+# Read-only JSON API (GET /api/domains[/<domain>]), disabled when unset; requires STATUS_API_TOKEN
+# sent as "Authorization: Bearer <token>".
+STATUS_API_PORT = os.getenv("STATUS_API_PORT")
+STATUS_API_TOKEN = os.getenv("STATUS_API_TOKEN")
+IMPORT_MAX_BYTES = 1024 * 1024
+MAX_DOMAINS = os.getenv("MAX_DOMAINS", "0")  # 0 means no limit on the watchlist size
+CHECK_COMMAND_LIMIT = 30  # domains accepted by a single ad-hoc /check
+TELEGRAM_MESSAGE_LIMIT = 4096
+UNAUTHORIZED_REPLY_INTERVAL = 60  # seconds between "not authorized" replies to the same chat
+HISTORY_LIMIT = 50  # status transitions kept per domain
+HISTORY_DEFAULT_COUNT = 10
+PROBLEM_THRESHOLD = os.getenv("PROBLEM_THRESHOLD", "3")  # consecutive failed checks before /problems lists a domain
+SEARCH_DEFAULT_COUNT = 50
+TOP_DEFAULT_COUNT = os.getenv("TOP_COUNT", "10")
+TOP_DEFAULT_WINDOW = os.getenv("TOP_WINDOW", "30d")
+CHECK_RUNS_LIMIT = 500  # rows kept in the blocked-count series behind /stats
+# When to send the summary digest, as a duration or cron expression (UTC) like CHECK_SCHEDULE,
+# e.g. "0 8 * * *" daily or "0 8 * * 1" weekly; disabled when unset. DIGEST_WINDOW is the period it covers.
+DIGEST_SCHEDULE = os.getenv("DIGEST_SCHEDULE")
+DIGEST_WINDOW = os.getenv("DIGEST_WINDOW", "1d")
+STATS_POINTS = os.getenv("STATS_POINTS", "12")
+LOG_FORMAT = os.getenv("LOG_FORMAT", "text").lower()  # "text" or "json"
+# Logs every Telegram API request and payload; far too noisy for production.
+BOT_DEBUG = env_flag("BOT_DEBUG")
 
-logging.basicConfig(
-    format="%(asctime)s - %(name)s - %(levelname)s - %(message)s", level=logging.INFO
-)
-logging.getLogger("httpx").setLevel(logging.WARNING)
+class JsonFormatter(logging.Formatter):
+    """Emits one JSON object per record, including any fields passed via `extra`."""
+    RESERVED = set(vars(logging.makeLogRecord({}))) | {"message", "asctime"}
+
+    def format(self, record: logging.LogRecord) -> str:
+        payload = {
+            "time": self.formatTime(record, "%Y-%m-%dT%H:%M:%S%z"),
+            "level": record.levelname,
+            "logger": record.name,
+            "msg": record.getMessage(),
+        }
+        payload.update({k: v for k, v in vars(record).items() if k not in self.RESERVED})
+        if record.exc_info: payload["exc"] = self.formatException(record.exc_info)
+        return json.dumps(payload, default=str, ensure_ascii=False)
+
+if LOG_FORMAT == "json":
+    _handler = logging.StreamHandler()
+    _handler.setFormatter(JsonFormatter())
+    logging.basicConfig(handlers=[_handler], level=logging.INFO)
+else:
+    logging.basicConfig(
+        format="%(asctime)s - %(name)s - %(levelname)s - %(message)s", level=logging.INFO
+    )
+if BOT_DEBUG:
+    logging.getLogger("telegram").setLevel(logging.DEBUG)
+    logging.getLogger("httpx").setLevel(logging.DEBUG)
+else:
+    logging.getLogger("httpx").setLevel(logging.WARNING)
 logger = logging.getLogger(__name__)
 
-# --- Data, API, and Formatting Functions ---
-def load_data() -> dict:
-    if not DATA_FILE.exists(): return {"chat_id": None, "domains": []}
+# --- Metrics ---
+CHECKS_TOTAL = Counter("domain_checks_total", "Completed watchlist checks.", ["trigger"])
+API_ERRORS_TOTAL = Counter("api_errors_total", "Domain lookups that failed after all retries.")
+DOMAINS_BLOCKED = Gauge("domains_blocked", "Domains blocked as of the last check.")
+API_LATENCY = Histogram("api_request_duration_seconds", "Latency of individual API requests.")
+
+# --- Storage ---
+class Store:
+    """SQLite-backed persistence for the watchlist, per-domain status and bot settings."""
+
+    def __init__(self, path: Path | str):
+        self.conn = sqlite3.connect(path, check_same_thread=False)
+        self.conn.row_factory = sqlite3.Row
+        with self.conn:
+            self.conn.executescript("""
+                CREATE TABLE IF NOT EXISTS domains (
+                    domain TEXT PRIMARY KEY,
+                    added_at TEXT NOT NULL,
+                    last_status TEXT,
+                    last_checked TEXT
+                );
+                CREATE TABLE IF NOT EXISTS settings (
+                    key TEXT PRIMARY KEY,
+                    value TEXT NOT NULL
+                );
+                CREATE TABLE IF NOT EXISTS history (
+                    id INTEGER PRIMARY KEY AUTOINCREMENT,
+                    domain TEXT NOT NULL,
+                    status TEXT NOT NULL,
+                    changed_at TEXT NOT NULL
+                );
+                CREATE INDEX IF NOT EXISTS history_domain ON history (domain, id);
+                CREATE TABLE IF NOT EXISTS check_runs (
+                    id INTEGER PRIMARY KEY AUTOINCREMENT,
+                    checked_at TEXT NOT NULL,
+                    blocked INTEGER NOT NULL,
+                    total INTEGER NOT NULL
+                );
+                CREATE TABLE IF NOT EXISTS domain_tags (
+                    domain TEXT NOT NULL,
+                    tag TEXT NOT NULL,
+                    PRIMARY KEY (domain, tag)
+                );
+            """)
+            self._add_column("domains", "last_notified", "TEXT")
+            self._add_column("domains", "enabled", "INTEGER NOT NULL DEFAULT 1")
+            self._add_column("domains", "check_interval", "INTEGER")
+            self._add_column("domains", "expires_at", "TEXT")
+            self._add_column("domains", "expiry_alerted", "TEXT")
+            self._add_column("domains", "priority", "INTEGER NOT NULL DEFAULT 0")
+            self._add_column("domains", "error_count", "INTEGER NOT NULL DEFAULT 0")
+            self._add_column("domains", "last_error", "TEXT")
+            self._add_column("domains", "last_attempt", "TEXT")
+
+    def _add_column(self, table: str, column: str, definition: str):
+        """Adds a column to a table created by an older version of the bot."""
+        columns = {row["name"] for row in self.conn.execute(f"PRAGMA table_info({table})")}
+        if column not in columns:
+            self.conn.execute(f"ALTER TABLE {table} ADD COLUMN {column} {definition}")
+
+    def close(self):
+        self.conn.close()
+
+    def get_setting(self, key: str, default=None):
+        row = self.conn.execute("SELECT value FROM settings WHERE key = ?", (key,)).fetchone()
+        return json.loads(row["value"]) if row else default
+
+    def set_setting(self, key: str, value):
+        with self.conn:
+            self.conn.execute(
+                "INSERT INTO settings (key, value) VALUES (?, ?) "
+                "ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+                (key, json.dumps(value)),
+            )
+
+    def list_domains(self, tag: str | None = None, enabled_only: bool = False) -> list[str]:
+        """Returns all domains, or only those carrying tag, priority domains first and then by domain.
+
+        With enabled_only, domains switched off with /disable are left out.
+        """
+        where = " AND d.enabled = 1" if enabled_only else ""
+        if tag is None:
+            rows = self.conn.execute(
+                f"SELECT domain FROM domains d WHERE 1 = 1{where} ORDER BY d.priority DESC, d.domain"
+            )
+        else:
+            rows = self.conn.execute(
+                "SELECT d.domain FROM domains d JOIN domain_tags t ON t.domain = d.domain "
+                f"WHERE t.tag = ?{where} ORDER BY d.priority DESC, d.domain",
+                (tag,),
+            )
+        return [row["domain"] for row in rows]
+
+    def set_enabled(self, domains: list[str], enabled: bool) -> list[str]:
+        """Switches checking on or off and returns the domains whose flag actually changed."""
+        changed = []
+        with self.conn:
+            for domain in domains:
+                cur = self.conn.execute(
+                    "UPDATE domains SET enabled = ? WHERE domain = ? AND enabled != ?",
+                    (int(enabled), domain, int(enabled)),
+                )
+                if cur.rowcount: changed.append(domain)
+        return changed
+
+    def set_interval(self, domains: list[str], seconds: int | None):
+        """Gives domains their own check interval; None returns them to the global schedule."""
+        with self.conn:
+            self.conn.executemany(
+                "UPDATE domains SET check_interval = ? WHERE domain = ?", [(seconds, d) for d in domains]
+            )
+
+    def set_priority(self, domains: list[str], priority: bool):
+        """Pins domains to be checked and reported first, or unpins them."""
+        with self.conn:
+            self.conn.executemany(
+                "UPDATE domains SET priority = ? WHERE domain = ?", [(int(priority), d) for d in domains]
+            )
+
+    def get_priority(self) -> set[str]:
+        return {row["domain"] for row in self.conn.execute("SELECT domain FROM domains WHERE priority = 1")}
+
+    def get_intervals(self) -> dict[str, int]:
+        """Returns the custom check interval of every domain that has one."""
+        rows = self.conn.execute("SELECT domain, check_interval FROM domains WHERE check_interval IS NOT NULL")
+        return {row["domain"]: row["check_interval"] for row in rows}
+
+    def list_due_domains(self, now: datetime) -> list[str]:
+        """Returns enabled domains with a custom interval whose last check is at least that long ago.
+
+        Failed checks count as attempts, so a domain the API keeps failing on waits its interval too.
+        """
+        due = []
+        rows = self.conn.execute(
+            "SELECT domain, check_interval, COALESCE(last_attempt, last_checked) AS last_attempt FROM domains "
+            "WHERE check_interval IS NOT NULL AND enabled = 1 ORDER BY priority DESC, domain"
+        )
+        for row in rows:
+            last = row["last_attempt"]
+            if last is None or (now - datetime.fromisoformat(last)).total_seconds() >= row["check_interval"]:
+                due.append(row["domain"])
+        return due
+
+    def get_disabled(self) -> set[str]:
+        return {row["domain"] for row in self.conn.execute("SELECT domain FROM domains WHERE enabled = 0")}
+
+    def search_domains(self, pattern: str, limit: int) -> list[sqlite3.Row]:
+        """Returns domains matching a case-insensitive substring, or a glob if pattern contains '*'."""
+        pattern = pattern.lower()
+        if "*" in pattern:
+            where, arg = "domain GLOB ?", pattern
+        else:
+            escaped = pattern.replace("\\", "\\\\").replace("%", "\\%").replace("_", "\\_")
+            where, arg = "domain LIKE ? ESCAPE '\\'", f"%{escaped}%"
+        return self.conn.execute(
+            f"SELECT domain, last_status FROM domains WHERE {where} ORDER BY domain LIMIT ?", (arg, limit)
+        ).fetchall()
+
+    def add_tags(self, domains: list[str], tags: list[str]) -> int:
+        """Attaches every tag to every (existing) domain, returning how many new pairs were stored."""
+        added = 0
+        with self.conn:
+            for domain in domains:
+                for tag in tags:
+                    cur = self.conn.execute(
+                        "INSERT OR IGNORE INTO domain_tags (domain, tag) "
+                        "SELECT domain, ? FROM domains WHERE domain = ?",
+                        (tag, domain),
+                    )
+                    added += cur.rowcount
+        return added
+
+    def remove_tag(self, domains: list[str], tag: str) -> int:
+        """Detaches tag from the domains, returning how many of them had it."""
+        with self.conn:
+            return sum(
+                self.conn.execute("DELETE FROM domain_tags WHERE domain = ? AND tag = ?", (domain, tag)).rowcount
+                for domain in domains
+            )
+
+    def get_tags(self) -> dict[str, list[str]]:
+        """Returns the tags of every tagged domain."""
+        tags: dict[str, list[str]] = {}
+        for row in self.conn.execute("SELECT domain, tag FROM domain_tags ORDER BY tag"):
+            tags.setdefault(row["domain"], []).append(row["tag"])
+        return tags
+
+    def list_domain_records(self) -> list[sqlite3.Row]:
+        """Returns every domain with its stored metadata, ordered by domain."""
+        return self.conn.execute(
+            "SELECT domain, added_at, last_status, last_checked FROM domains ORDER BY domain"
+        ).fetchall()
+
+    def add_domains(self, domains: list[str]) -> list[str]:
+        """Inserts the domains in a single transaction and returns the ones that were new."""
+        now = datetime.now(timezone.utc).isoformat()
+        added = []
+        with self.conn:
+            for domain in domains:
+                cur = self.conn.execute(
+                    "INSERT OR IGNORE INTO domains (domain, added_at) VALUES (?, ?)", (domain, now)
+                )
+                if cur.rowcount: added.append(domain)
+        return added
+
+    def remove_domains(self, domains: list[str]) -> list[str]:
+        """Deletes the domains in a single transaction and returns the ones that existed."""
+        removed = []
+        with self.conn:
+            for domain in domains:
+                cur = self.conn.execute("DELETE FROM domains WHERE domain = ?", (domain,))
+                if cur.rowcount: removed.append(domain)
+                self.conn.execute("DELETE FROM history WHERE domain = ?", (domain,))
+                self.conn.execute("DELETE FROM domain_tags WHERE domain = ?", (domain,))
+        return removed
+
+    def clear_domains(self) -> int:
+        """Deletes every domain and its history, returning how many domains were removed."""
+        with self.conn:
+            count = self.conn.execute("DELETE FROM domains").rowcount
+            self.conn.execute("DELETE FROM history")
+            self.conn.execute("DELETE FROM domain_tags")
+        return count
+
+    def get_statuses(self) -> dict:
+        """Returns the last-known blocked state for every enabled domain that has been checked."""
+        rows = self.conn.execute(
+            "SELECT domain, last_status FROM domains WHERE last_status IS NOT NULL AND enabled = 1"
+        )
+        return {row["domain"]: row["last_status"] == "blocked" for row in rows}
+
+    def set_expiry(self, domain: str, expires_at: str | None):
+        with self.conn:
+            self.conn.execute("UPDATE domains SET expires_at = ? WHERE domain = ?", (expires_at, domain))
+
+    def list_expiring(self, before: str) -> list[sqlite3.Row]:
+        """Returns enabled domains expiring before the given ISO time that haven't been alerted for that expiry."""
+        return self.conn.execute(
+            "SELECT domain, expires_at FROM domains WHERE enabled = 1 AND expires_at IS NOT NULL "
+            "AND expires_at < ? AND (expiry_alerted IS NULL OR expiry_alerted != expires_at) ORDER BY expires_at",
+            (before,),
+        ).fetchall()
+
+    def mark_expiry_alerted(self, domains: list[str]):
+        with self.conn:
+            self.conn.executemany(
+                "UPDATE domains SET expiry_alerted = expires_at WHERE domain = ?", [(d,) for d in domains]
+            )
+
+    def get_last_notified(self) -> dict[str, str]:
+        rows = self.conn.execute("SELECT domain, last_notified FROM domains WHERE last_notified IS NOT NULL")
+        return {row["domain"]: row["last_notified"] for row in rows}
+
+    def mark_notified(self, domains: list[str], notified_at: str):
+        with self.conn:
+            for domain in domains:
+                self.conn.execute("UPDATE domains SET last_notified = ? WHERE domain = ?", (notified_at, domain))
+
+    def update_statuses(self, results: dict, checked_at: str):
+        """Stores the API status of every successful result; failed checks keep their old status.
+
+        A history entry is appended whenever a domain's status differs from its previous one.
+        Failed checks count towards the domain's consecutive error count, which a success resets.
+        Either way the domain's last_attempt is set to checked_at.
+        """
+        with self.conn:
+            for domain, result in results.items():
+                if "error" in result:
+                    self.conn.execute(
+                        "UPDATE domains SET error_count = error_count + 1, last_error = ?, last_attempt = ? "
+                        "WHERE domain = ?",
+                        (result["error"], checked_at, domain),
+                    )
+                    continue
+                status = result.get("status", "unknown").lower()
+                row = self.conn.execute("SELECT last_status FROM domains WHERE domain = ?", (domain,)).fetchone()
+                if row is None: continue
+                self.conn.execute(
+                    "UPDATE domains SET last_status = ?, last_checked = ?, last_attempt = ?, error_count = 0, "
+                    "last_error = NULL WHERE domain = ?",
+                    (status, checked_at, checked_at, domain),
+                )
+                if row["last_status"] != status:
+                    self._record_transition(domain, status, checked_at)
+
+    def list_problems(self, threshold: int) -> list[sqlite3.Row]:
+        """Returns domains that failed at least threshold checks in a row, most failures first."""
+        return self.conn.execute(
+            "SELECT domain, error_count, last_error FROM domains WHERE error_count >= ? "
+            "ORDER BY error_count DESC, domain",
+            (threshold,),
+        ).fetchall()
+
+    def _record_transition(self, domain: str, status: str, changed_at: str):
+        self.conn.execute(
+            "INSERT INTO history (domain, status, changed_at) VALUES (?, ?, ?)", (domain, status, changed_at)
+        )
+        self.conn.execute(
+            "DELETE FROM history WHERE domain = ? AND id NOT IN "
+            "(SELECT id FROM history WHERE domain = ? ORDER BY id DESC LIMIT ?)",
+            (domain, domain, HISTORY_LIMIT),
+        )
+
+    def get_history(self, domain: str, limit: int) -> list[sqlite3.Row]:
+        """Returns the most recent status transitions for a domain, newest first."""
+        return self.conn.execute(
+            "SELECT status, changed_at FROM history WHERE domain = ? ORDER BY id DESC LIMIT ?",
+            (domain, limit),
+        ).fetchall()
+
+    def get_all_history(self) -> list[sqlite3.Row]:
+        """Returns every stored transition of watched domains, oldest first per domain."""
+        return self.conn.execute(
+            "SELECT domain, status, changed_at FROM history ORDER BY domain, id"
+        ).fetchall()
+
+    def record_check_run(self, checked_at: str, blocked: int, total: int):
+        with self.conn:
+            self.conn.execute(
+                "INSERT INTO check_runs (checked_at, blocked, total) VALUES (?, ?, ?)", (checked_at, blocked, total)
+            )
+            self.conn.execute(
+                "DELETE FROM check_runs WHERE id NOT IN (SELECT id FROM check_runs ORDER BY id DESC LIMIT ?)",
+                (CHECK_RUNS_LIMIT,),
+            )
+
+    def count_check_runs(self, since: str) -> int:
+        return self.conn.execute("SELECT COUNT(*) FROM check_runs WHERE checked_at >= ?", (since,)).fetchone()[0]
+
+    def get_check_runs(self, limit: int) -> list[sqlite3.Row]:
+        """Returns the most recent check runs, oldest first."""
+        rows = self.conn.execute(
+            "SELECT checked_at, blocked, total FROM check_runs ORDER BY id DESC LIMIT ?", (limit,)
+        ).fetchall()
+        return rows[::-1]
+
+    def migrate_legacy_files(self, data_file: Path, status_file: Path):
+        """Imports the old domains.json/status.json once, then renames them out of the way."""
+        if data_file.exists():
+            try:
+                with open(data_file, "r") as f:
+                    data = json.load(f)
+                # Hand-edited files may carry stray whitespace, \r or uppercase letters.
+                domains = [d.strip().lower() for d in data.get("domains", []) if isinstance(d, str) and d.strip()]
+                added = self.add_domains(domains)
+                if data.get("chat_id") and self.get_setting("chat_id") is None:
+                    self.set_setting("chat_id", data["chat_id"])
+                data_file.rename(data_file.with_suffix(".json.migrated"))
+                logger.info(f"Migrated {len(added)} domains from {data_file}.")
+            except (json.JSONDecodeError, IOError) as e:
+                logger.error(f"Error migrating {data_file}: {e}")
+        if status_file.exists():
+            try:
+                with open(status_file, "r") as f:
+                    status = json.load(f)
+                checked_at = status.get("last_check") or datetime.now(timezone.utc).isoformat()
+                self.update_statuses(
+                    {d: {"status": "blocked" if b else "allowed"} for d, b in status.get("domains", {}).items()},
+                    checked_at,
+                )
+                if status.get("last_check"):
+                    self.set_setting("last_check", {
+                        "time": status["last_check"],
+                        "blocked": status.get("blocked", 0),
+                        "clear": status.get("clear", 0),
+                    })
+                status_file.rename(status_file.with_suffix(".json.migrated"))
+                logger.info(f"Migrated check status from {status_file}.")
+            except (json.JSONDecodeError, IOError) as e:
+                logger.error(f"Error migrating {status_file}: {e}")
+
+store: Store | None = None
+# Names of the lists loaded from DOMAINS_DIR, usable as "/add <name> domain.com".
+domain_lists: list[str] = []
+
+def import_domain_lists(directory: Path) -> tuple[list[str], list[str], list[str]]:
+    """Syncs the watchlist with every <name>.txt in directory, its domains tagged #<name>.
+
+    Runs on each start and /reload. Domains already on the watchlist just gain the tag;
+    domains no longer in a file lose it and are removed once they carry no tag at all. A
+    list whose file was deleted counts as empty, one that can't be read is left alone.
+    Files that separate entries with commas or spaces are rewritten once with one entry per line.
+    Returns the names of the lists that were loaded and the domains added and removed.
+    """
+    names, added, untagged, unreadable = [], [], [], set()
+    for path in sorted(directory.glob("*.txt")):
+        name = path.stem.lower()
+        if not TAG_RE.match(f"#{name}"):
+            logger.warning(f"Skipping {path}: '{name}' is not a valid list name.")
+            continue
+        try:
+            content = path.read_text(encoding="utf-8")
+        except (OSError, UnicodeDecodeError) as e:
+            logger.error(f"Could not read domain list {path}: {e}")
+            unreadable.add(name)
+            continue
+        # One-time cleanup so files that mix commas and spaces end up newline-separated
+        # and a repeated domain is only kept where it first appears.
+        normalized = normalize_list_file(content)
+        rewritten = dedupe_list_file(normalized or content) or normalized
+        if rewritten is not None:
+            try:
+                write_atomic(path, rewritten.encode("utf-8"))
+                logger.info(f"Rewrote {path} with one domain per line and no duplicates.")
+            except OSError as e:
+                logger.warning(f"Could not rewrite {path}: {e}")
+        raw_domains = parse_import_file(content)
+        domains = []
+        for raw in raw_domains:
+            try:
+                domain = validate_domain(raw)
+            except ValueError as e:
+                logger.warning(f"Skipping invalid domain in {path}: {e}")
+                continue
+            if domain in domains: logger.warning(f"Duplicate domain {domain} in {path}, checking it once.")
+            else: domains.append(domain)
+        new = store.add_domains(domains)
+        store.add_tags(domains, [f"#{name}"])
+        gone = [d for d in store.list_domains(f"#{name}") if d not in domains]
+        store.remove_tag(gone, f"#{name}")
+        logger.info(f"Loaded list '{name}' from {path}: {len(domains)} domains, {len(new)} new, {len(gone)} gone.")
+        names.append(name)
+        added += new
+        untagged += gone
+    for name in store.get_setting("domain_lists", []):
+        if name in names or name in unreadable: continue
+        gone = store.list_domains(f"#{name}")
+        store.remove_tag(gone, f"#{name}")
+        logger.info(f"List '{name}' no longer exists, untagged its {len(gone)} domains.")
+        untagged += gone
+    store.set_setting("domain_lists", names + sorted(unreadable))
+    tags = store.get_tags()
+    removed = store.remove_domains(sorted({d for d in untagged if d not in tags}))
+    if removed: logger.info(f"Removed {len(removed)} domains no longer on any list: {', '.join(removed)}")
+    return names, added, removed
+
+def list_label(domain: str, tags: dict[str, list[str]]) -> str:
+    """Returns "[name] " for the DOMAINS_DIR lists a domain belongs to, or "" outside list mode."""
+    names = [t[1:] for t in tags.get(domain, []) if t[1:] in domain_lists]
+    return f"[{', '.join(names)}] " if names else ""
+
+# --- API and Formatting Functions ---
+def parse_delay(raw: str) -> float:
+    """Parses "500ms", "1.5s" or a plain millisecond count into seconds."""
+    raw = raw.strip().lower()
+    if raw.endswith("ms"): value = float(raw[:-2]) / 1000
+    elif raw.endswith("s"): value = float(raw[:-1])
+    else: value = float(raw) / 1000
+    if value < 0: raise ValueError(f"delay must not be negative: '{raw}'")
+    return value
+
+class RateLimiter:
+    """Spaces out calls so that at most one starts every `interval` seconds, shared by all workers."""
+
+    def __init__(self, interval: float):
+        self.interval = interval
+        self._lock = asyncio.Lock()
+        self._next_slot = 0.0
+
+    async def wait(self):
+        async with self._lock:
+            now = time.monotonic()
+            if self._next_slot > now:
+                await asyncio.sleep(self._next_slot - now)
+                now = self._next_slot
+            self._next_slot = now + self.interval
+
+api_rate_limiter = RateLimiter(0)
+
+class ChatRateLimiter:
+    """Queues sends per chat so each chat gets at most one message per min_interval and
+    per_minute messages in any 60 seconds. A flood wait from Telegram pauses the chat."""
+
+    def __init__(self, min_interval: float, per_minute: int):
+        self.min_interval, self.per_minute = min_interval, per_minute
+        self._locks: dict[int, asyncio.Lock] = {}
+        self._sent: dict[int, deque] = {}
+        self._paused_until: dict[int, float] = {}
+
+    async def wait(self, chat_id: int):
+        async with self._locks.setdefault(chat_id, asyncio.Lock()):
+            sent = self._sent.setdefault(chat_id, deque(maxlen=self.per_minute))
+            now = time.monotonic()
+            ready = self._paused_until.get(chat_id, now)
+            if sent: ready = max(ready, sent[-1] + self.min_interval)
+            if len(sent) == self.per_minute: ready = max(ready, sent[0] + 60)
+            if ready > now:
+                await asyncio.sleep(ready - now)
+                now = ready
+            sent.append(now)
+
+    def pause(self, chat_id: int, seconds: float):
+        self._paused_until[chat_id] = max(self._paused_until.get(chat_id, 0.0), time.monotonic() + seconds)
+
+send_rate_limiter = ChatRateLimiter(SEND_MIN_INTERVAL, SEND_PER_MINUTE)
+# Parsed from HTTP_TIMEOUT / CHECK_DEADLINE / NOTIFY_COOLDOWN / RESULT_CACHE_TTL in main().
+http_timeout = 10.0
+check_deadline = 600.0
+notify_cooldown = 0
+result_cache_ttl = 60
+
+check_concurrency = 4  # parsed from CHECK_CONCURRENCY by load_config(), at most MAX_CHECK_CONCURRENCY
+
+def build_api_session() -> requests.Session:
+    """Creates the Session shared by all API requests so TLS connections are reused across checks."""
+    session = requests.Session()
+    # Enough pooled connections for every concurrent worker; retries are handled by check_domain_status.
+    adapter = HTTPAdapter(pool_connections=1, pool_maxsize=check_concurrency, max_retries=0)
+    session.mount("https://", adapter)
+    session.mount("http://", adapter)
+    return session
+
+def proxy_map(proxy: str | None) -> dict | None:
+    """The per-scheme proxies for requests, or None to leave it to HTTP_PROXY / HTTPS_PROXY."""
+    return {"http": proxy, "https": proxy} if proxy else None
+
+# Passed per request: requests lets proxy env vars override Session.proxies, but not these.
+api_proxies = proxy_map(API_PROXY)
+
+api_session = build_api_session()
+
+def http_request(method: str, url: str, params: dict) -> tuple[int, str]:
+    """Blocking request that reads the whole body and releases the connection back to the pool.
+
+    GET sends params in the query string; POST sends them as a form body.
+    """
+    if method == "POST":
+        kwargs = {"data": params}
+    else:
+        kwargs = {"params": params}
+    with api_session.request(method, url, timeout=http_timeout, proxies=api_proxies, **kwargs) as response:
+        return response.status_code, response.text
+
+API_ERROR_BODY_LIMIT = 200
+
+class APIError(Exception):
+    """Raised when the API answers with a non-2xx status code."""
+
+    def __init__(self, status_code: int, body: str):
+        self.status_code = status_code
+        self.body = body
+        if len(body) > API_ERROR_BODY_LIMIT: body = body[:API_ERROR_BODY_LIMIT] + "…"
+        super().__init__(f"HTTP {status_code}: {body.strip() or '(empty body)'}")
+
+    @property
+    def retryable(self) -> bool:
+        # Rate limiting and server errors are transient; other client errors won't change on retry.
+        return self.status_code == 429 or self.status_code >= 500
+
+def no_result() -> dict:
+    """The result recorded for a submitted domain the backend returned nothing for."""
+    return {"error": "no result", "missing": True}
+
+# Optional response fields and the names the API may send them under.
+RESULT_EXTRA_FIELDS = {
+    "reason": ("reason", "block_reason"),
+    "provider": ("provider", "isp"),
+    "checked_at": ("checked_at", "timestamp"),
+}
+
+def normalize_result(domain: str, result: dict) -> dict:
+    """Lowercases the domain echoed by the API and warns when it doesn't match the one submitted.
+
+    Optional fields listed in RESULT_EXTRA_FIELDS are copied under their canonical
+    name when present as non-empty scalars and dropped otherwise.
+    """
+    if "error" in result: return result
+    if not result.get("status"):
+        logger.warning(f"API response for {domain} has no status: {result}")
+        return no_result()
+    echoed = str(result.get("domain") or "").strip().lower().rstrip(".")
+    if not echoed:
+        logger.warning(f"API response for {domain} does not name a domain: {result}")
+    elif echoed != domain:
+        logger.warning(f"API response for {domain} names a different domain: {echoed}")
+    result["domain"] = domain
+    if "status" in result: result["status"] = str(result["status"]).lower()
+    for field, names in RESULT_EXTRA_FIELDS.items():
+        value = next((result.pop(n) for n in names if n in result), None)
+        if isinstance(value, (str, int, float)) and str(value).strip(): result[field] = str(value).strip()
+    return result
+
+class Checker(ABC):
+    """A blocklist backend. Results are {"domain", "status"} dicts, or {"error": reason} on failure."""
+
+    @abstractmethod
+    async def check(self, domains: list[str]) -> dict:
+        """Returns one result per domain, keyed by domain in the order given."""
+
+class IndiwtfChecker(Checker):
+    """Checks domains one request at a time against the indiwtf.com API, with retries.
+
+    base_url and token default to the configured values; pass them explicitly to
+    point the checker at a local mock server.
+    """
+
+    def __init__(self, base_url: str | None = None, token: str | None = None, method: str | None = None):
+        self.base_url = (base_url or INDIWTF_API_BASE_URL).rstrip("/")
+        self.token = token if token is not None else INDIWTF_TOKEN
+        self.method = (method or API_METHOD).upper()
+
+    async def fetch_raw(self, domain: str, method: str | None = None) -> tuple[str, int, str]:
+        """Sends one unretried request and returns the request as shown to users, the status and the raw body.
+
+        The token is masked in both. GET shows the query string; POST shows the form body.
+        """
+        method = method or self.method
+        url = f"{self.base_url}/check"
+        params = {"domain": domain, "token": self.token}
+        await api_rate_limiter.wait()
+        loop = asyncio.get_running_loop()
+        with API_LATENCY.time():
+            status_code, body = await loop.run_in_executor(None, http_request, method, url, params)
+        if method == "POST": shown = f"POST {url} (form: domain={domain}&token=***)"
+        else: shown = f"GET {url}?domain={domain}&token=***"
+        if self.token: body = body.replace(self.token, "***")
+        return shown, status_code, body
+
+    async def fetch(self, domain: str) -> dict:
+        """Performs a single API request. Raises APIError, requests.RequestException or ValueError on failure.
+
+        If POST is configured but the API rejects it with 405, falls back to GET for good.
+        """
+        method = self.method
+        _, status_code, body = await self.fetch_raw(domain, method)
+        if status_code == 405 and method == "POST":
+            if self.method == "POST":
+                logger.warning("API does not accept POST requests, falling back to GET.")
+                self.method = "GET"
+            _, status_code, body = await self.fetch_raw(domain, "GET")
+        if not 200 <= status_code < 300:
+            raise APIError(status_code, body)
+        # An empty body or {} would otherwise read as "no status"; raising makes it retried like any other glitch.
+        if not body.strip(): raise ValueError("empty API response, status unknown")
+        data = json.loads(body)
+        if not isinstance(data, dict) or not data: raise ValueError("empty API response, status unknown")
+        return data
+
+    async def check_domain(self, domain: str) -> dict:
+        """Checks a domain, retrying transient failures with exponential backoff."""
+        if not self.token: return {"error": "Indiwtf API token is not configured."}
+        domain = domain.strip().lower()
+        last_error = None
+        for attempt in range(1, API_MAX_ATTEMPTS + 1):
+            try:
+                return normalize_result(domain, await self.fetch(domain))
+            except APIError as e:
+                if not e.retryable:
+                    logger.error(f"API check failed for {domain}: {e}", extra={"event": "api_error", "domain": domain})
+                    API_ERRORS_TOTAL.inc()
+                    return {"error": str(e)}
+                last_error = e
+            except (requests.RequestException, ValueError) as e:
+                last_error = e
+            if attempt < API_MAX_ATTEMPTS:
+                delay = API_RETRY_BASE_DELAY * 2 ** (attempt - 1)
+                logger.warning(f"API check attempt {attempt} failed for {domain}: {last_error}; retrying in {delay}s")
+                await asyncio.sleep(delay)
+        logger.error(
+            f"API check failed for {domain} after {API_MAX_ATTEMPTS} attempts: {last_error}",
+            extra={"event": "api_error", "domain": domain},
+        )
+        API_ERRORS_TOTAL.inc()
+        return {"error": str(last_error)}
+
+    async def check(self, domains: list[str]) -> dict:
+        return await check_concurrently(domains, self.check_domain)
+
+# Backends selectable with CHECK_BACKEND.
+CHECKERS = {"indiwtf": IndiwtfChecker}
+checker: Checker | None = None
+
+# --- Registration Data (RDAP) ---
+class RDAPError(Exception):
+    """The registry has no usable RDAP data for a domain, or the lookup failed.
+
+    permanent is set when retrying soon won't help, e.g. the TLD has no RDAP service.
+    """
+
+    def __init__(self, message: str, permanent: bool = False):
+        super().__init__(message)
+        self.permanent = permanent
+
+def rdap_get(domain: str) -> dict:
+    """Blocking RDAP lookup; rdap.org redirects to the registry responsible for the TLD."""
+    url = f"{RDAP_BASE_URL}/domain/{domain}"
     try:
-        with open(DATA_FILE, "r") as f:
-            data = json.load(f)
-            data.setdefault("chat_id", None); data.setdefault("domains", [])
-            return data
-    except (json.JSONDecodeError, IOError) as e:
-        logger.error(f"Error loading data from {DATA_FILE}: {e}")
-        return {"chat_id": None, "domains": []}
+        with requests.get(
+            url, timeout=http_timeout, proxies=api_proxies, headers={"Accept": "application/rdap+json"}
+        ) as response:
+            if response.status_code == 404: raise RDAPError("no RDAP data for this domain or TLD", permanent=True)
+            if response.status_code != 200: raise RDAPError(f"HTTP {response.status_code}")
+            return response.json()
+    except requests.RequestException as e:
+        raise RDAPError(str(e))
+    except ValueError:
+        raise RDAPError("invalid RDAP response")
+
+def parse_rdap(data: dict) -> dict:
+    """Extracts expiry (UTC ISO), registrar name and status list from an RDAP domain object."""
+    info = {"expires_at": None, "registrar": None, "status": [str(s) for s in data.get("status", [])]}
+    for event in data.get("events", []):
+        if event.get("eventAction") == "expiration" and event.get("eventDate"):
+            try:
+                expires = datetime.fromisoformat(event["eventDate"].replace("Z", "+00:00"))
+                info["expires_at"] = expires.astimezone(timezone.utc).isoformat()
+            except ValueError:
+                logger.warning(f"Unparseable RDAP expiration date: {event['eventDate']}")
+    for entity in data.get("entities", []):
+        if "registrar" not in entity.get("roles", []): continue
+        # vcardArray is ["vcard", [[name, params, type, value], ...]]; "fn" holds the display name.
+        for item in (entity.get("vcardArray") or [None, []])[1]:
+            if item and item[0] == "fn": info["registrar"] = item[3]
+    return info
 
-def save_data(data: dict):
+# RDAP answers by domain with the monotonic time they were fetched; permanent errors are cached too.
+rdap_cache: dict[str, tuple[float, dict | RDAPError]] = {}
+
+async def rdap_lookup(domain: str) -> dict:
+    """Returns parse_rdap's fields, reusing answers younger than RDAP_CACHE_TTL. Raises RDAPError."""
+    entry = rdap_cache.get(domain)
+    if entry and time.monotonic() - entry[0] < RDAP_CACHE_TTL:
+        if isinstance(entry[1], RDAPError): raise entry[1]
+        return entry[1]
+    loop = asyncio.get_running_loop()
     try:
-        with open(DATA_FILE, "w") as f:
-            unique_domains = sorted(list(set(data.get("domains", []))))
-            data["domains"] = unique_domains
-            json.dump(data, f, indent=2)
-    except IOError as e: logger.error(f"Error saving data to {DATA_FILE}: {e}")
+        info = parse_rdap(await loop.run_in_executor(None, rdap_get, domain))
+    except RDAPError as e:
+        if e.permanent: rdap_cache[domain] = (time.monotonic(), e)
+        raise
+    rdap_cache[domain] = (time.monotonic(), info)
+    return info
+
+async def expiry_check(context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Refreshes the expiry date of every enabled domain and warns about the ones expiring soon.
+
+    Each expiry date is alerted once; a renewal moves the date and re-arms the warning.
+    """
+    domains, _ = split_ips(store.list_domains(enabled_only=True))
+    logger.info(f"Refreshing registration expiry for {len(domains)} domains.")
+    for i, domain in enumerate(domains):
+        if i: await asyncio.sleep(RDAP_DELAY)
+        try:
+            store.set_expiry(domain, (await rdap_lookup(domain))["expires_at"])
+        except RDAPError as e:
+            logger.warning(f"RDAP lookup failed for {domain}: {e}")
+    now = datetime.now(timezone.utc)
+    expiring = store.list_expiring((now + timedelta(days=expiry_warn_days)).isoformat())
+    if not expiring: return
+    lines = []
+    for row in expiring:
+        days = (datetime.fromisoformat(row["expires_at"]) - now).days
+        when = f"in {days} days" if days >= 0 else "already"
+        lines.append(f"{row['domain']} expires {when} ({format_timestamp(row['expires_at'])})")
+    await notify(context, with_icon("⏳", "Registration expiring soon") + "\n\n" + "\n".join(lines), critical=True)
+    store.mark_expiry_alerted([row["domain"] for row in expiring])
+
+# --- DNS Lookups ---
+def parse_resolvers(raw: str) -> dict[str, str]:
+    """Parses "name=IP,..." into {name: IP}. Raises ValueError for malformed entries."""
+    resolvers = {}
+    for entry in (e.strip() for e in raw.split(",")):
+        if not entry: continue
+        name, sep, address = entry.partition("=")
+        if not sep or not name.strip(): raise ValueError(f"expected name=IP, got '{entry}'")
+        try:
+            resolvers[name.strip()] = str(ipaddress.ip_address(address.strip()))
+        except ValueError:
+            raise ValueError(f"'{address.strip()}' is not an IP address")
+    return resolvers
 
-async def check_domain_status(domain: str) -> dict:
-    if not INDIWTF_TOKEN: return {"error": "Indiwtf API token is not configured."}
-    url = f"{INDIWTF_API_BASE_URL}/check?domain={domain}&token={INDIWTF_TOKEN}"
+# Parsed from DNS_RESOLVERS in main().
+dns_resolvers: dict[str, str] = {}
+
+async def resolve_with(nameserver: str | None, domain: str) -> list[str] | str:
+    """Returns the sorted A records from one resolver (None for the system one), or an error description."""
+    resolver = dns.asyncresolver.Resolver(configure=nameserver is None)
+    if nameserver is not None: resolver.nameservers = [nameserver]
+    resolver.lifetime = DNS_TIMEOUT
     try:
-        loop = asyncio.get_running_loop()
-        response = await loop.run_in_executor(None, lambda: requests.get(url, timeout=10))
-        response.raise_for_status()
-        return response.json()
-    except Exception as e:
-        logger.error(f"API check failed for {domain}: {e}")
-        try: return response.json()
-        except: return {"error": str(e)}
+        answer = await resolver.resolve(domain, "A")
+    except dns.exception.Timeout:
+        return "timed out"
+    except dns.exception.DNSException as e:
+        return type(e).__name__
+    return sorted(r.address for r in answer)
+
+async def compare_resolvers(domain: str) -> dict[str, list[str] | str]:
+    """Resolves domain through the system resolver and every configured one concurrently."""
+    servers = {"system": None, **dns_resolvers}
+    answers = await asyncio.gather(*(resolve_with(ns, domain) for ns in servers.values()))
+    return dict(zip(servers, answers))
+
+def format_dns_report(domain: str, answers: dict[str, list[str] | str]) -> str:
+    """Lists the answer of each resolver and flags the ones that disagree with the most common answer."""
+    keys = [tuple(a) if isinstance(a, list) else a for a in answers.values()]
+    majority = max(keys, key=keys.count)
+    lines = [with_icon("🌐", f"DNS for {domain}\n")]
+    for (name, answer), key in zip(answers.items(), keys):
+        text = ", ".join(answer) if isinstance(answer, list) else f"error: {answer}"
+        flag = "" if key == majority else " " + with_icon("⚠️", "differs")
+        lines.append(f"{name}: {text or 'no records'}{flag}")
+    if len(set(keys)) > 1: lines.append("\nResolvers disagree, which can indicate DNS poisoning.")
+    return "\n".join(lines)
 
 # --- PERUBAHAN 1: Mengubah total format pesan status sesuai gambar kedua ---
+# The single place that turns a domain status into display text, shared by every report.
+STATUS_LABELS = {"blocked": ("❌", "Blocked"), "clear": ("✅", "OK")}
+
+def status_label(blocked: bool) -> str:
+    """Returns "❌ Blocked" / "✅ OK", or "[BLOCKED]" / "[OK]" when USE_EMOJI is off."""
+    emoji, text = STATUS_LABELS["blocked" if blocked else "clear"]
+    return f"{emoji} {text}" if USE_EMOJI else f"[{text.upper()}]"
+
+def with_icon(icon: str, text: str) -> str:
+    """Prefixes text with an emoji unless USE_EMOJI is off."""
+    return f"{icon} {text}" if USE_EMOJI else text
+
 def format_status_message(result: dict, domain_to_check: str) -> str:
     """Formats the API result to match the new desired format."""
+    if result.get("missing"):
+        return with_icon("⚠️", f"no result: {domain_to_check}")
     if "error" in result:
-        return f"❌ Error checking {domain_to_check}: {result['error']}"
+        return with_icon("❌", f"Error checking {domain_to_check}: {result['error']}")
     
     status = result.get("status", "unknown").upper()
     domain = result.get("domain", domain_to_check)
@@ -65,161 +1081,2613 @@ def format_status_message(result: dict, domain_to_check: str) -> str:
     # Buat URL lengkap yang akan otomatis menjadi link oleh Telegram
     full_url = f"https://{domain}/"
 
-    if status == "BLOCKED":
-        emoji = "❌"
-        status_text = "Blocked"
-    else:  # "OK" atau status lain dianggap "OK"
-        emoji = "✅"
-        status_text = "OK"
-        
+    # "OK" atau status lain dianggap "OK"
     # Gabungkan menjadi format baru: https://domain.com/: ✅ OK
-    return f"{full_url}: {emoji} {status_text}"
+    line = f"{full_url}: {status_label(status == 'BLOCKED')}"
+    details = [result["reason"]] if result.get("reason") else []
+    if result.get("provider"): details.append(f"via {result['provider']}")
+    if status == "BLOCKED" and details: line += f" ({', '.join(details)})"
+    if result.get("cached"): line += " (cached)"
+    return line
+
+def format_export(records: list[sqlite3.Row]) -> str:
+    """Renders domains and their last-known status as CSV; unchecked domains have an empty status."""
+    buffer = io.StringIO()
+    writer = csv.writer(buffer, lineterminator="\n")
+    writer.writerow(["domain", "status"])
+    for record in records:
+        status = record["last_status"]
+        writer.writerow([record["domain"], "" if status is None else "blocked" if status == "blocked" else "clear"])
+    return buffer.getvalue()
+
+ENTRY_SEPARATOR_RE = re.compile(r"[,\s]+")
+
+def is_csv_export(content: str) -> bool:
+    """True if the first non-comment line is a "domain,..." header, as written by /export."""
+    for line in content.splitlines():
+        line = line.split("#", 1)[0].strip().lower()
+        if line: return line.split(",", 1)[0].strip() == "domain"
+    return False
+
+def parse_import_file(content: str) -> list[str]:
+    """Extracts the domains of a list file, ignoring blanks and # comments.
+
+    Entries may be separated by newlines, commas or spaces, mixed freely. A file
+    starting with a "domain,..." CSV header is read by its first column instead.
+    Lines are trimmed (which also drops the \\r of CRLF files) and lowercased.
+    Comments may fill a whole line or follow a domain ("example.com  # prod").
+    """
+    csv_export = is_csv_export(content)
+    domains = []
+    for line in content.splitlines():
+        line = line.split("#", 1)[0].strip().lower()
+        if not line: continue
+        if csv_export:
+            first_column = line.split(",", 1)[0].strip()
+            if first_column != "domain": domains.append(first_column)
+        else:
+            domains.extend(e for e in ENTRY_SEPARATOR_RE.split(line) if e)
+    return domains
+
+def normalize_list_file(content: str) -> str | None:
+    """Rewrites lines holding several entries as one entry per line.
+
+    Whole-line comments and single-entry lines are kept as they are; an inline comment
+    stays with the last entry of its line. Returns None if nothing needs to change.
+    """
+    if is_csv_export(content): return None
+    lines, changed = [], False
+    for line in content.splitlines():
+        entry_part, sep, comment = line.partition("#")
+        entries = [e for e in ENTRY_SEPARATOR_RE.split(entry_part.strip()) if e]
+        if len(entries) <= 1:
+            lines.append(line)
+            continue
+        changed = True
+        lines.extend(entries[:-1])
+        lines.append(f"{entries[-1]}  #{comment}" if sep else entries[-1])
+    return "\n".join(lines) + "\n" if changed else None
+
+def dedupe_list_file(content: str) -> str | None:
+    """Drops lines repeating a domain seen earlier in the file, keeping the first one.
+
+    Expects one entry per line, as left by normalize_list_file. Comments, blanks and
+    invalid entries are kept as they are. Returns None if there are no duplicates.
+    """
+    csv_export = is_csv_export(content)
+    seen, lines, changed = set(), [], False
+    for line in content.splitlines():
+        entry = line.split("#", 1)[0].strip().lower()
+        if csv_export: entry = entry.split(",", 1)[0].strip()
+        try:
+            domain = validate_domain(entry) if entry else None
+        except ValueError:
+            domain = None
+        if domain is not None:
+            if domain in seen:
+                changed = True
+                continue
+            seen.add(domain)
+        lines.append(line)
+    return "\n".join(lines) + "\n" if changed else None
+
+def write_atomic(path: Path, data: bytes):
+    """Writes data to path via a synced temp file and rename, so readers never see a partial file."""
+    path.parent.mkdir(parents=True, exist_ok=True)
+    tmp = path.with_name(f".{path.name}.tmp")
+    with open(tmp, "wb") as f:
+        f.write(data)
+        f.flush()
+        os.fsync(f.fileno())
+    os.replace(tmp, path)
+
+def rotate_files(directory: Path, pattern: str, keep: int):
+    """Deletes all but the newest `keep` files matching pattern (names must sort by age)."""
+    for old in sorted(directory.glob(pattern))[:-keep or None]:
+        old.unlink()
 
 def get_domains_from_message(text: str) -> list[str]:
     parts = text.split(maxsplit=1)
     if len(parts) < 2: return []
-    raw_domains = parts[1].split()
+    # Accept domains separated by spaces, newlines, or commas.
+    raw_domains = re.split(r"[\s,]+", parts[1])
     cleaned_domains = [
         d.lower().replace("https://", "").replace("http://", "").strip("/")
         for d in raw_domains if d.strip()
     ]
     return cleaned_domains
 
+TAG_RE = re.compile(r"^#[a-z0-9_-]{1,32}$")
+
+def split_tags(tokens: list[str]) -> tuple[list[str], list[str]]:
+    """Separates "#tag" tokens from domains. Raises ValueError for malformed tags."""
+    domains, tags = [], []
+    for token in tokens:
+        if not token.startswith("#"):
+            domains.append(token)
+            continue
+        tag = token.lower()
+        if not TAG_RE.match(tag):
+            raise ValueError(f"invalid tag '{token}' (use # followed by letters, digits, - or _)")
+        if tag not in tags: tags.append(tag)
+    return domains, tags
+
+def split_flags(tokens: list[str], known: dict[str, bool]) -> tuple[list[str], dict]:
+    """Separates "--flag" tokens from the rest.
+
+    known maps each accepted flag to whether it takes a value (the following token).
+    Flags without a value are returned as True. Raises ValueError for unknown flags.
+    """
+    rest, flags = [], {}
+    tokens = list(tokens)
+    while tokens:
+        token = tokens.pop(0)
+        if not token.startswith("--"):
+            rest.append(token)
+            continue
+        if token not in known:
+            raise ValueError(f"unknown option '{token}' (supported: {', '.join(known)})")
+        if known[token]:
+            if not tokens: raise ValueError(f"option '{token}' needs a value")
+            flags[token] = tokens.pop(0)
+        else:
+            flags[token] = True
+    return rest, flags
+
+def get_tag_argument(context: ContextTypes.DEFAULT_TYPE) -> str | None:
+    """Returns the first "#tag" command argument, if any."""
+    for arg in context.args or []:
+        if arg.startswith("#"): return arg.lower()
+    return None
+
+DOMAIN_LABEL_RE = re.compile(r"^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$")
+
+def is_ip(entry: str) -> bool:
+    """True for watchlist entries that are IP addresses rather than domains."""
+    try:
+        ipaddress.ip_address(entry)
+        return True
+    except ValueError:
+        return False
+
+def split_ips(entries: list[str]) -> tuple[list[str], list[str]]:
+    """Separates domains from IP addresses, which the API can't check."""
+    return [e for e in entries if not is_ip(e)], [e for e in entries if is_ip(e)]
+
+def validate_domain(raw: str) -> str:
+    """Normalizes user input to a bare lowercase domain or IP address.
+
+    Strips a leading scheme and anything after the host. IPv4 and IPv6 addresses
+    (bracketed or not) are returned in canonical form. Raises ValueError with a
+    human-readable reason when the result is not a plausible domain name.
+    """
+    domain = raw.strip().lower()
+    domain = re.sub(r"^[a-z][a-z0-9+.-]*://", "", domain)
+    domain = re.split(r"[/?#]", domain, maxsplit=1)[0]
+    bracketed = re.fullmatch(r"\[([0-9a-f:.]+)\](?::\d+)?", domain)
+    if bracketed: domain = bracketed.group(1)
+    if is_ip(domain): return str(ipaddress.ip_address(domain))
+    domain = domain.rsplit(":", 1)[0] if domain.count(":") == 1 else domain
+    if is_ip(domain): return str(ipaddress.ip_address(domain))
+    domain = domain.rstrip(".")
+    if not domain: raise ValueError("empty domain")
+    if "." not in domain: raise ValueError("missing a dot")
+    if len(domain) > 253: raise ValueError("longer than 253 characters")
+    for label in domain.split("."):
+        if not DOMAIN_LABEL_RE.match(label):
+            raise ValueError(f"invalid label '{label}' (only letters, digits and inner hyphens allowed)")
+    return domain
+
+SPARK_CHARS = "▁▂▃▄▅▆▇█"
+
+def sparkline(values: list[int]) -> str:
+    if not values: return ""
+    low, high = min(values), max(values)
+    if high == low: return SPARK_CHARS[0] * len(values)
+    return "".join(SPARK_CHARS[(v - low) * (len(SPARK_CHARS) - 1) // (high - low)] for v in values)
+
+def get_display_timezone() -> ZoneInfo:
+    try: return ZoneInfo(TZ_DISPLAY)
+    except (ZoneInfoNotFoundError, ValueError):
+        logger.warning(f"Unknown TZ_DISPLAY '{TZ_DISPLAY}', falling back to UTC.")
+        return ZoneInfo("UTC")
+
+def parse_quiet_hours(spec: str) -> tuple[dt_time, dt_time]:
+    """Parses "HH:MM-HH:MM" into start and end times. Raises ValueError if malformed or empty."""
+    match = re.fullmatch(r"\s*(\d{1,2}):(\d{2})\s*-\s*(\d{1,2}):(\d{2})\s*", spec)
+    if not match: raise ValueError(f"expected HH:MM-HH:MM, got '{spec}'")
+    h1, m1, h2, m2 = (int(g) for g in match.groups())
+    start, end = dt_time(h1, m1), dt_time(h2, m2)  # raises ValueError for e.g. 25:00
+    if start == end: raise ValueError("start and end must differ")
+    return start, end
+
+# Parsed from QUIET_HOURS in main().
+quiet_hours: tuple[dt_time, dt_time] | None = None
+
+def in_quiet_hours(now: datetime) -> bool:
+    """True if now falls inside the quiet window; windows may wrap past midnight (22:00-07:00)."""
+    if quiet_hours is None: return False
+    start, end = quiet_hours
+    local = now.astimezone(get_display_timezone()).time().replace(tzinfo=None)
+    if start < end: return start <= local < end
+    return local >= start or local < end
+
+def format_timestamp(iso_time: str) -> str:
+    """Renders a stored UTC ISO timestamp in the configured display timezone."""
+    local = datetime.fromisoformat(iso_time).astimezone(get_display_timezone())
+    return local.strftime("%Y-%m-%d %H:%M %Z")
+
+DURATION_RE = re.compile(r"^(?:(\d+)d)?(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s)?$")
+
+def parse_duration(spec: str) -> int | None:
+    """Parses durations like "15m" or "1h30m" into seconds; returns None if spec isn't one."""
+    match = DURATION_RE.match(spec.strip().lower())
+    if not match or not any(match.groups()): return None
+    days, hours, minutes, seconds = (int(g or 0) for g in match.groups())
+    return ((days * 24 + hours) * 60 + minutes) * 60 + seconds
+
+def parse_schedule(spec: str) -> int | CronTrigger:
+    """Returns an interval in seconds for durations, or a CronTrigger for cron expressions.
+
+    Raises ValueError with a readable message if the spec is neither.
+    """
+    interval = parse_duration(spec)
+    if interval is not None:
+        if interval <= 0: raise ValueError(f"schedule interval must be positive: '{spec}'")
+        return interval
+    try:
+        return CronTrigger.from_crontab(spec, timezone=timezone.utc)
+    except ValueError as e:
+        raise ValueError(f"'{spec}' is neither a duration (e.g. 15m) nor a valid cron expression: {e}")
+
+# The scheduled periodic_check job, or None while checks are paused.
+check_job = None
+# The effective schedule spec; starts as CHECK_SCHEDULE and can be changed with /setinterval.
+check_schedule = CHECK_SCHEDULE
+
+DUE_CHECK_INTERVAL = 60  # how often domains with their own interval are looked at, in seconds
+MIN_DOMAIN_INTERVAL = 60
+
+def schedule_checks(job_queue: JobQueue, spec: str):
+    """Registers periodic_check on the job queue according to spec and returns the job."""
+    schedule = parse_schedule(spec)
+    if isinstance(schedule, int):
+        return job_queue.run_repeating(periodic_check, interval=schedule, first=10, name="periodic_check")
+    return job_queue.run_custom(periodic_check, job_kwargs={"trigger": schedule}, name="periodic_check")
+
+def reschedule(job_queue: JobQueue, spec: str) -> None:
+    """Switches scheduled checks to spec and persists it.
+
+    The spec is validated and the new job registered before the old one is removed, so a
+    bad spec raises ValueError and leaves the current schedule untouched. While paused only
+    the stored spec changes.
+    """
+    global check_job, check_schedule
+    parse_schedule(spec)
+    if check_job is not None:
+        old_job = check_job
+        check_job = schedule_checks(job_queue, spec)
+        old_job.schedule_removal()
+    check_schedule = spec
+    store.set_setting("check_schedule", spec)
+    # Remembered so a later change to CHECK_SCHEDULE itself can retire this override.
+    store.set_setting("check_schedule_base", CHECK_SCHEDULE)
+
+def stored_check_schedule() -> str:
+    """The schedule to start with: the /setinterval override, unless CHECK_SCHEDULE changed since it was set."""
+    stored, base = store.get_setting("check_schedule"), store.get_setting("check_schedule_base")
+    if not stored or stored == CHECK_SCHEDULE: return CHECK_SCHEDULE
+    if base is not None and base != CHECK_SCHEDULE:
+        logger.info(f"CHECK_SCHEDULE changed from '{base}' to '{CHECK_SCHEDULE}'; dropping /setinterval '{stored}'.")
+        store.set_setting("check_schedule", None)
+        return CHECK_SCHEDULE
+    try:
+        parse_schedule(stored)
+    except ValueError as e:
+        logger.warning(f"Ignoring stored schedule set with /setinterval: {e}")
+        return CHECK_SCHEDULE
+    logger.warning(f"Using /setinterval schedule '{stored}' over CHECK_SCHEDULE '{CHECK_SCHEDULE}'.")
+    return stored
+
+def next_run_times(spec: str, count: int = 3, now: datetime | None = None) -> list[datetime]:
+    """The next count run times for a schedule spec. Intervals count from the live job's next run when there is one."""
+    now = now or datetime.now(timezone.utc)
+    schedule = parse_schedule(spec)
+    if isinstance(schedule, int):
+        first = check_job.next_t if check_job is not None and check_job.next_t else now + timedelta(seconds=schedule)
+        return [first + timedelta(seconds=schedule * i) for i in range(count)]
+    times, previous = [], None
+    while len(times) < count:
+        previous = schedule.get_next_fire_time(previous, previous + timedelta(seconds=1) if previous else now)
+        if previous is None: break
+        times.append(previous)
+    return times
+
+def parse_admin_ids(raw: str) -> set[int]:
+    """Parses a comma-separated list of chat IDs. Raises ValueError on empty or non-numeric input."""
+    entries = [e.strip() for e in raw.split(",") if e.strip()]
+    if not entries: raise ValueError("no chat IDs given")
+    invalid = [e for e in entries if not re.fullmatch(r"-?\d+", e)]
+    if invalid: raise ValueError(f"non-numeric chat IDs: {', '.join(invalid)}")
+    return {int(e) for e in entries}
+
+admin_ids: set[int] = set()
+viewer_ids: set[int] = set()
+
+# Commands and callback prefixes a viewer may use; everything else needs an admin.
+VIEWER_COMMANDS = {
+    "start", "list", "search", "status", "uptime", "schedule", "check", "dns", "info",
+    "history", "diff", "compare", "problems", "top", "stats", "digest", "ping", "whoami",
+}
+VIEWER_CALLBACKS = ("list:",)
+
+def viewer_allowed(update: Update) -> bool:
+    """True if the update is a read-only command or callback that viewers may use."""
+    if update.callback_query is not None:
+        return (update.callback_query.data or "").startswith(VIEWER_CALLBACKS)
+    message = update.effective_message
+    if message is None or not message.text or not message.text.startswith("/"): return False
+    command = message.text.split(maxsplit=1)[0][1:].split("@", 1)[0].lower()
+    return command in VIEWER_COMMANDS
+
+def get_notify_chat_ids() -> list[int]:
+    """Chats that receive scheduled notifications: every admin, or the /start chat in legacy mode."""
+    if admin_ids: return sorted(admin_ids)
+    chat_id = store.get_setting("chat_id")
+    return [chat_id] if chat_id else []
+
+def split_message(text: str, limit: int = TELEGRAM_MESSAGE_LIMIT) -> list[str]:
+    """Splits text into chunks under limit, breaking on line boundaries where possible."""
+    chunks, current = [], ""
+    for line in text.split("\n"):
+        # A single line longer than the limit has to be cut mid-line.
+        while len(line) > limit:
+            if current: chunks.append(current); current = ""
+            chunks.append(line[:limit]); line = line[limit:]
+        candidate = f"{current}\n{line}" if current else line
+        if len(candidate) > limit:
+            chunks.append(current); current = line
+        else:
+            current = candidate
+    if current: chunks.append(current)
+    return chunks
+
+def notify_thread_id(chat_id: int) -> int | None:
+    """The topic notifications go to in chat_id: MESSAGE_THREAD_ID for groups (negative IDs), else none."""
+    return int(MESSAGE_THREAD_ID) if MESSAGE_THREAD_ID and chat_id < 0 else None
+
+def reply_thread_id(update: Update) -> int | None:
+    """The forum topic a command was sent from, so replies sent with bot.send_message land there too."""
+    message = update.effective_message
+    return message.message_thread_id if message is not None and message.is_topic_message else None
+
+async def send_with_retry(bot, chat_id: int, text: str, thread_id: int | None = None) -> None:
+    """Sends one message, retrying network errors and flood waits with exponential backoff.
+
+    Sends go through the per-chat rate limiter; a flood wait pauses that chat for the
+    retry_after Telegram asks for. Errors a retry can't fix, such as a bad request or a
+    bot blocked by the user, are raised straight away.
+    """
+    for attempt in range(1, SEND_MAX_ATTEMPTS + 1):
+        await send_rate_limiter.wait(chat_id)
+        try:
+            await bot.send_message(chat_id=chat_id, text=text, message_thread_id=thread_id)
+            return
+        except RetryAfter as e:
+            delay = e.retry_after.total_seconds() if isinstance(e.retry_after, timedelta) else e.retry_after
+            send_rate_limiter.pause(chat_id, delay)
+            logger.warning(f"Flood wait for chat {chat_id}: holding its messages for {delay:g}s")
+            if attempt == SEND_MAX_ATTEMPTS: raise
+            continue
+        except BadRequest:
+            raise
+        except NetworkError as e:
+            if attempt == SEND_MAX_ATTEMPTS: raise
+            delay = SEND_RETRY_BASE_DELAY * 2 ** (attempt - 1)
+            logger.warning(f"Sending to {chat_id} failed (attempt {attempt}): {e}; retrying in {delay}s")
+        await asyncio.sleep(delay)
+
+async def send_long_message(bot, chat_id: int, text: str, thread_id: int | None = None) -> None:
+    """Sends text as one or more messages so each stays under Telegram's length limit."""
+    for chunk in split_message(text):
+        await send_with_retry(bot, chat_id, chunk, thread_id)
+
+async def reply_long(update: Update, context: ContextTypes.DEFAULT_TYPE, text: str) -> None:
+    """Replies with send_long_message in the chat and forum topic the command came from."""
+    await send_long_message(context.bot, update.effective_chat.id, text, reply_thread_id(update))
+
+# A malformed message or a chat that blocked the bot fails the same way on every retry.
+UNDELIVERABLE_ERRORS = (BadRequest, Forbidden)
+
+def queue_undelivered(chat_id: int, chunks: list[str]) -> None:
+    """Stores messages that could not be sent so the next check can deliver them."""
+    queue = store.get_setting("undelivered", []) + [{"chat_id": chat_id, "text": c} for c in chunks]
+    if len(queue) > UNDELIVERED_LIMIT:
+        logger.error(f"Undelivered queue is full, dropping {len(queue) - UNDELIVERED_LIMIT} oldest messages.")
+        queue = queue[-UNDELIVERED_LIMIT:]
+    store.set_setting("undelivered", queue)
+
+async def flush_undelivered(context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Retries queued messages in order, keeping the ones that still fail.
+
+    Sends can yield to other tasks, so whatever they queue meanwhile is merged back
+    in rather than overwritten.
+    """
+    queue = store.get_setting("undelivered", [])
+    if not queue: return
+    done = []
+    for entry in queue:
+        try:
+            await send_with_retry(context.bot, entry["chat_id"], entry["text"], notify_thread_id(entry["chat_id"]))
+        except UNDELIVERABLE_ERRORS as e:
+            logger.error(f"Dropping queued message for {entry['chat_id']}, it cannot be delivered: {e}")
+        except Exception as e:
+            logger.error(f"Redelivery to {entry['chat_id']} failed: {e}")
+            continue
+        done.append(entry)
+    logger.info(f"Redelivered or dropped {len(done)} of {len(queue)} queued messages.")
+    remaining = store.get_setting("undelivered", [])
+    for entry in done:
+        if entry in remaining: remaining.remove(entry)
+    store.set_setting("undelivered", remaining)
+
+# --- Notifiers ---
+class Notifier(ABC):
+    """A sink for reports and alerts. Sinks handle their own delivery failures and never raise."""
+
+    @abstractmethod
+    async def send(self, context: ContextTypes.DEFAULT_TYPE, text: str) -> None:
+        """Delivers text to everyone this sink notifies."""
+
+    def available(self) -> bool:
+        """False while the sink has nobody to deliver to."""
+        return True
+
+class TelegramNotifier(Notifier):
+    def available(self) -> bool:
+        return bool(get_notify_chat_ids())
+
+    async def send(self, context: ContextTypes.DEFAULT_TYPE, text: str) -> None:
+        """Sends text to every notify chat; messages that fail for retryable reasons wait for the next check."""
+        for chat_id in get_notify_chat_ids():
+            chunks = split_message(text)
+            for i, chunk in enumerate(chunks):
+                try:
+                    await send_with_retry(context.bot, chat_id, chunk, notify_thread_id(chat_id))
+                except UNDELIVERABLE_ERRORS as e:
+                    logger.error(f"Failed to send message to {chat_id}, not retrying: {e}")
+                    break
+                except Exception as e:
+                    logger.error(f"Failed to send message to {chat_id}, queued for redelivery: {e}")
+                    queue_undelivered(chat_id, chunks[i:])
+                    break
+
+class SlackNotifier(Notifier):
+    """Posts to a Slack incoming webhook."""
+
+    def __init__(self, webhook_url: str | None = None):
+        self.webhook_url = webhook_url or SLACK_WEBHOOK_URL
+
+    async def send(self, context: ContextTypes.DEFAULT_TYPE, text: str) -> None:
+        if not await post_json_with_retry(self.webhook_url, {"text": text}, "Slack notification"):
+            logger.error("Slack notification dropped.")
+
+class EmailNotifier(Notifier):
+    """Sends mail through the SMTP_* server; notifications go out as plain text."""
+
+    def __init__(self):
+        self.recipients = [r.strip() for r in (SMTP_TO or "").split(",") if r.strip()]
+
+    def _deliver(self, message: EmailMessage) -> None:
+        if SMTP_SECURITY == "ssl":
+            server = smtplib.SMTP_SSL(SMTP_HOST, smtp_port, timeout=http_timeout)
+        else:
+            server = smtplib.SMTP(SMTP_HOST, smtp_port, timeout=http_timeout)
+        with server:
+            if SMTP_SECURITY == "starttls": server.starttls()
+            if SMTP_USER: server.login(SMTP_USER, SMTP_PASSWORD or "")
+            server.send_message(message)
+
+    async def send_email(self, subject: str, text: str, html_body: str | None = None) -> bool:
+        """Sends one email to every recipient and returns whether the server accepted it."""
+        message = EmailMessage()
+        message["Subject"], message["From"], message["To"] = subject, SMTP_FROM, ", ".join(self.recipients)
+        message.set_content(text)
+        if html_body: message.add_alternative(html_body, subtype="html")
+        try:
+            await asyncio.get_running_loop().run_in_executor(None, self._deliver, message)
+        except (smtplib.SMTPException, OSError) as e:
+            logger.error(f"Sending email '{subject}' failed: {e}")
+            return False
+        return True
+
+    async def send(self, context: ContextTypes.DEFAULT_TYPE, text: str) -> None:
+        await self.send_email("Domain checker notification", text)
+
+NOTIFIERS = {"telegram": TelegramNotifier, "slack": SlackNotifier, "email": EmailNotifier}
+# Built from NOTIFIER in main().
+notifiers: list[Notifier] = [TelegramNotifier()]
+# Set in main() when SMTP_HOST is configured; used for emailed reports.
+email_notifier: EmailNotifier | None = None
+
+def parse_notifiers(raw: str) -> list[str]:
+    """Parses NOTIFIER into sink names. Raises ValueError on unknown or missing names."""
+    names = list(dict.fromkeys(n.strip().lower() for n in raw.split(",") if n.strip()))
+    if not names: raise ValueError("no notifier given")
+    unknown = [n for n in names if n not in NOTIFIERS]
+    if unknown: raise ValueError(f"unknown {', '.join(unknown)}, expected: {', '.join(NOTIFIERS)}")
+    return names
+
+async def broadcast(context: ContextTypes.DEFAULT_TYPE, text: str) -> None:
+    """Sends text through every configured notifier."""
+    for notifier in notifiers:
+        await notifier.send(context, text)
+
 # --- Job/Check Function ---
-# --- PERUBAHAN 2: Mengubah header laporan dan menghapus parse_mode ---
+# Held while a check is running so shutdown can wait for it to finish writing results.
+check_lock = asyncio.Lock()
+
+# Successful results by domain with the monotonic time they were fetched.
+result_cache: dict[str, tuple[float, dict]] = {}
+
+async def run_checks(domains: list[str], use_cache: bool = False) -> dict:
+    """Checks domains with the configured backend.
+
+    The result always follows the submitted list: extra keys from the backend are
+    dropped and any domain it didn't answer for is marked as having no result.
+    With use_cache, results fetched within RESULT_CACHE_TTL are reused and marked
+    as cached; every successful fresh result refreshes the cache.
+    """
+    now = time.monotonic()
+    cached = {}
+    if use_cache:
+        for domain in domains:
+            entry = result_cache.get(domain)
+            if entry and now - entry[0] < result_cache_ttl: cached[domain] = {**entry[1], "cached": True}
+    to_check = [d for d in domains if d not in cached]
+    raw = await checker.check(to_check) if to_check else {}
+    extra = set(raw) - set(to_check)
+    if extra: logger.warning(f"Backend returned results for domains not requested: {', '.join(sorted(extra))}")
+    results = {}
+    for domain in domains:
+        if domain in cached:
+            results[domain] = cached[domain]
+            continue
+        if domain not in raw: logger.warning(f"Backend returned no result for {domain}")
+        results[domain] = raw.get(domain) or no_result()
+        if "error" not in results[domain]: result_cache[domain] = (now, results[domain])
+    return results
+
+async def check_concurrently(domains: list[str], check_one) -> dict:
+    """Runs check_one for each domain with up to check_concurrency calls in flight.
+
+    Returns the result per domain in the original order. A failing
+    domain yields an error result without aborting the others, and domains
+    still unchecked when the check deadline passes are reported as errors.
+    """
+    semaphore = asyncio.Semaphore(check_concurrency)
+
+    async def worker(domain: str) -> dict:
+        async with semaphore:
+            return await check_one(domain)
+
+    # Each domain is queried once per run, even if it was submitted twice.
+    tasks = {domain: asyncio.create_task(worker(domain)) for domain in dict.fromkeys(domains)}
+    if not tasks: return {}
+    _, pending = await asyncio.wait(tasks.values(), timeout=check_deadline)
+    if pending:
+        logger.error(f"Check deadline of {check_deadline:g}s exceeded, {len(pending)} domains unchecked.")
+        for task in pending: task.cancel()
+        await asyncio.gather(*pending, return_exceptions=True)
+    results = {}
+    for domain, task in tasks.items():
+        if task.cancelled():
+            outcome = {"error": "check deadline exceeded"}
+        elif task.exception() is not None:
+            logger.error(f"Unexpected error checking {domain}: {task.exception()}")
+            outcome = {"error": str(task.exception())}
+        else:
+            outcome = task.result()
+        results[domain] = outcome
+    return results
+
+def report_order(results: dict) -> list[str]:
+    """Domains in report order: priority domains first, each part alphabetical.
+
+    Before the store is opened, e.g. while load_config validates a template, it is just alphabetical.
+    """
+    priority = store.get_priority() if store is not None else set()
+    return sorted(results, key=lambda d: (d not in priority, d))
+
+def format_report(results: dict, verbose: bool = False) -> str:
+    """Groups results into blocked, clear and failed sections, priority domains first in each.
+
+    Clear domains are only listed individually when verbose is set; otherwise just counted.
+    """
+    blocked, clear, failed = [], [], []
+    for domain in report_order(results):
+        result = results[domain]
+        if "error" in result: failed.append(format_status_message(result, domain))
+        elif result.get("status", "").lower() == "blocked": blocked.append(format_status_message(result, domain))
+        else: clear.append(format_status_message(result, domain))
+
+    report_lines = ["Domain Check Results\n", with_icon("🚫", f"Blocked ({len(blocked)})")]
+    report_lines.extend(blocked)
+    report_lines.append("\n" + with_icon("✅", f"Clear ({len(clear)})"))
+    if verbose: report_lines.extend(clear)
+    if failed:
+        report_lines.append("\n" + with_icon("⚠️", f"Errors ({len(failed)})"))
+        report_lines.extend(failed)
+    if not verbose and clear:
+        report_lines.append("\nUse /checknow verbose to list clear domains.")
+    return "\n".join(report_lines)
+
+# Compiled from REPORT_TEMPLATE / REPORT_TEMPLATE_FILE in main().
+report_template: Template | None = None
+
+def report_fields(results: dict, checked_at: str | None = None) -> dict:
+    """The values a report template can use, e.g. $blocked_count or $blocked_list."""
+    groups = {"blocked": [], "clear": [], "error": []}
+    for domain in report_order(results):
+        result = results[domain]
+        if "error" in result: group = "error"
+        elif result.get("status", "").lower() == "blocked": group = "blocked"
+        else: group = "clear"
+        groups[group].append((domain, format_status_message(result, domain)))
+    fields = {
+        "total": len(results),
+        "domains": ", ".join(sorted(results)),
+        "checked_at": format_timestamp(checked_at or datetime.now(timezone.utc).isoformat()),
+    }
+    for name, entries in groups.items():
+        fields[f"{name}_count"] = len(entries)
+        fields[f"{name}_domains"] = ", ".join(d for d, _ in entries)
+        fields[f"{name}_list"] = "\n".join(line for _, line in entries)
+    return fields
+
+def load_report_template() -> Template | None:
+    """Reads and validates the configured template. Raises ValueError if it is unusable."""
+    if REPORT_TEMPLATE_FILE:
+        try:
+            text = Path(REPORT_TEMPLATE_FILE).read_text(encoding="utf-8")
+        except (OSError, UnicodeDecodeError) as e:
+            raise ValueError(f"cannot read {REPORT_TEMPLATE_FILE}: {e}")
+    elif REPORT_TEMPLATE:
+        text = REPORT_TEMPLATE.replace("\\n", "\n")
+    else:
+        return None
+    template = Template(text)
+    try:
+        template.substitute(report_fields({"example.com": {"status": "blocked"}}))
+    except KeyError as e:
+        raise ValueError(f"unknown field ${e.args[0]}")
+    except ValueError as e:
+        raise ValueError(str(e))
+    return template
+
+def render_report(results: dict, verbose: bool = False) -> str:
+    """Renders the report with the configured template, or the built-in layout without one."""
+    if report_template is None: return format_report(results, verbose)
+    return report_template.substitute(report_fields(results))
+
+def format_run_summary(results: dict, duration: float) -> str:
+    """One-line summary of a check run, e.g. "Checked 120 domains over 4.2s; 2 errors; 7 blocked"."""
+    errors = sum(1 for r in results.values() if "error" in r)
+    blocked = sum(1 for r in results.values() if "error" not in r and r.get("status", "").lower() == "blocked")
+    return f"Checked {len(results)} domains over {duration:.1f}s; {errors} errors; {blocked} blocked"
+
+def diff_and_notify(previous: dict | None, results: dict) -> tuple[dict, dict]:
+    """Compares fresh results with the last-known state.
+
+    Returns the new state and a notification line keyed by each domain whose
+    blocked value flipped. Domains without a previous state (including every
+    domain on the first-ever run) are seeded silently; failed checks keep their
+    old state.
+    """
+    state = dict(previous or {})
+    changes = {}
+    for domain, result in results.items():
+        if "error" in result: continue
+        blocked = result.get("status", "").lower() == "blocked"
+        if domain in state and state[domain] != blocked:
+            changes[domain] = format_status_message(result, domain)
+        state[domain] = blocked
+    # Drop domains that are no longer on the watchlist.
+    state = {d: b for d, b in state.items() if d in results}
+    return state, changes
+
+def record_check(results: dict) -> tuple[dict[str, str], list[str]]:
+    """Diffs the results against the stored state and persists the new state and summary.
+
+    Returns the change line per domain and the domains that went from blocked to clear, leaving
+    out domains that were already notified within NOTIFY_COOLDOWN.
+    """
+    previous = store.get_statuses()
+    state, changes = diff_and_notify(previous, results)
+    now = datetime.now(timezone.utc).isoformat()
+    last_notified = store.get_last_notified()
+    cooldown_start = (datetime.now(timezone.utc) - timedelta(seconds=notify_cooldown)).isoformat()
+    notify = []
+    for domain in changes:
+        blocked = state[domain]
+        suppressed = last_notified.get(domain, "") > cooldown_start
+        logger.info(
+            f"{domain} is now {'blocked' if blocked else 'clear'}"
+            + (" (notification suppressed by cooldown)" if suppressed else ""),
+            extra={"event": "status_change", "domain": domain, "blocked": blocked, "suppressed": suppressed},
+        )
+        if not suppressed: notify.append(domain)
+    store.mark_notified(notify, now)
+    if STATUS_WEBHOOK_URL and changes and not DRY_RUN:
+        events = [
+            {"domain": d, "oldStatus": "clear" if state[d] else "blocked",
+             "newStatus": "blocked" if state[d] else "clear", "timestamp": now}
+            for d in changes
+        ]
+        task = asyncio.get_running_loop().create_task(post_status_events(events))
+        webhook_tasks.add(task)
+        task.add_done_callback(webhook_tasks.discard)
+    unblocked = [d for d in notify if not state[d]]
+    # Baseline for /diff: the state as it was before this check.
+    store.set_setting("previous_statuses", previous)
+    store.update_statuses(results, now)
+    tags = store.get_tags() if domain_lists else {}
+    # Count over the whole watchlist so a check of a tagged subset keeps the summary accurate.
+    current = store.get_statuses()
+    blocked = sum(1 for b in current.values() if b)
+    DOMAINS_BLOCKED.set(blocked)
+    store.set_setting("last_check", {"time": now, "blocked": blocked, "clear": len(current) - blocked})
+    store.record_check_run(now, blocked, len(current))
+    return {d: list_label(d, tags) + changes[d] for d in notify}, unblocked
+
+# Deliveries in flight, referenced so they aren't garbage-collected before they finish.
+webhook_tasks: set[asyncio.Task] = set()
+
+def post_json(url: str, payload: dict) -> int:
+    """Blocking JSON POST; returns the status code."""
+    with requests.post(url, json=payload, timeout=http_timeout) as response:
+        return response.status_code
+
+async def post_json_with_retry(url: str, payload: dict, label: str) -> bool:
+    """POSTs payload, retrying failures and non-2xx answers with exponential backoff. Returns success."""
+    loop = asyncio.get_running_loop()
+    for attempt in range(1, STATUS_WEBHOOK_ATTEMPTS + 1):
+        try:
+            status_code = await loop.run_in_executor(None, post_json, url, payload)
+            if 200 <= status_code < 300: return True
+            error = f"HTTP {status_code}"
+        except requests.RequestException as e:
+            error = str(e)
+        if attempt == STATUS_WEBHOOK_ATTEMPTS:
+            logger.error(f"{label} failed after {attempt} attempts: {error}")
+            return False
+        delay = STATUS_WEBHOOK_RETRY_BASE_DELAY * 2 ** (attempt - 1)
+        logger.warning(f"{label} failed ({error}); retrying in {delay}s")
+        await asyncio.sleep(delay)
+    return False
+
+async def post_status_events(events: list[dict]) -> None:
+    """POSTs each status change to STATUS_WEBHOOK_URL in the background."""
+    for event in events:
+        await post_json_with_retry(STATUS_WEBHOOK_URL, event, f"Status webhook for {event['domain']}")
+
+async def notify(context: ContextTypes.DEFAULT_TYPE, text: str, critical: bool = False) -> None:
+    """Broadcasts a notification, or holds it during quiet hours unless it is critical and allowed through."""
+    if in_quiet_hours(datetime.now(timezone.utc)) and not (critical and QUIET_ALLOW_BLOCKED):
+        store.set_setting("quiet_held", store.get_setting("quiet_held", []) + [text])
+        logger.info("Notification held for quiet hours.")
+        return
+    await broadcast(context, text)
+
+async def flush_quiet_held(context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Sends everything held during quiet hours as one summary once the window is over."""
+    if in_quiet_hours(datetime.now(timezone.utc)): return
+    held = store.get_setting("quiet_held", [])
+    if not held: return
+    store.set_setting("quiet_held", [])
+    await broadcast(context, with_icon("🌙", f"Held during quiet hours ({len(held)})") + "\n\n" + "\n\n".join(held))
+
+async def notify_changes(context: ContextTypes.DEFAULT_TYPE, changes: dict[str, str], unblocked: list[str], summary: str):
+    """Reports status changes; newly blocked domains count as critical for quiet hours."""
+    critical = [line for d, line in changes.items() if d not in unblocked]
+    if QUIET_ALLOW_BLOCKED and critical and in_quiet_hours(datetime.now(timezone.utc)):
+        await notify(context, "Status Changes\n\n" + "\n".join(critical) + "\n\n" + summary, critical=True)
+        rest = [line for d, line in changes.items() if d in unblocked]
+        if rest: await notify(context, "Status Changes\n\n" + "\n".join(rest))
+        return
+    await notify(context, "Status Changes\n\n" + "\n".join(changes.values()) + "\n\n" + summary, critical=bool(critical))
+
+async def notify_unblocked(context: ContextTypes.DEFAULT_TYPE, domains: list[str]) -> None:
+    """Sends one recovery alert per domain, separate from the regular report."""
+    if not NOTIFY_UNBLOCKED: return
+    for domain in domains:
+        await notify(context, with_icon("🎉", f"UNBLOCKED: {domain}"))
+
+# Smallest run whose total failure is blamed on the API; a lone domain can fail on its own.
+API_OUTAGE_MIN_DOMAINS = 3
+
+def is_api_outage(results: dict) -> bool:
+    """True when every domain in a run failed, which points at the API rather than the domains."""
+    return len(results) >= API_OUTAGE_MIN_DOMAINS and all("error" in r for r in results.values())
+
+# Set once the outage alert has gone out, so a long outage produces a single alert.
+api_outage_alerted = False
+
+async def handle_api_outage(context: ContextTypes.DEFAULT_TYPE, results: dict) -> bool:
+    """Alerts on a total API outage and returns True if this run should be skipped.
+
+    The alert is broadcast once per outage; the first scheduled run with any
+    successful result ends the outage.
+    """
+    global api_outage_alerted
+    if not is_api_outage(results):
+        if api_outage_alerted:
+            api_outage_alerted = False
+            logger.info("API is reachable again.", extra={"event": "api_recovered"})
+        return False
+    logger.error(f"All {len(results)} checks failed, skipping this run.", extra={"event": "api_outage"})
+    if not api_outage_alerted:
+        api_outage_alerted = True
+        await notify(context, with_icon("🚨", "API unreachable, check skipped"), critical=True)
+    return True
+
 async def periodic_check(context: ContextTypes.DEFAULT_TYPE) -> None:
-    """The core function that checks all domains and sends a report."""
+    """Scheduled check of every domain on the global schedule."""
+    intervals = store.get_intervals()
+    domains, _ = split_ips([d for d in store.list_domains(enabled_only=True) if d not in intervals])
     logger.info("Running domain check...")
-    data = load_data()
-    chat_id, domains = data.get("chat_id"), data.get("domains", [])
-    if not chat_id:
+    if not domains:
+        logger.info("No domains on the global schedule, nothing to check.")
+        return
+    await scheduled_check(context, domains, "scheduled")
+
+async def due_check(context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Checks the domains with their own interval (/add --every) that are due."""
+    if store.get_setting("paused", False): return
+    domains, _ = split_ips(store.list_due_domains(datetime.now(timezone.utc)))
+    if domains: await scheduled_check(context, domains, "interval")
+
+async def scheduled_check(context: ContextTypes.DEFAULT_TYPE, domains: list[str], trigger: str) -> None:
+    """Checks domains in the background and only reports those whose blocked status changed."""
+    if not any(n.available() for n in notifiers):
         logger.warning("Check triggered but no chat_id is configured. Use /start.")
         return
+    if check_lock.locked():
+        logger.warning(f"Previous domain check is still running, skipping this {trigger} run.")
+        return
+    async with check_lock:
+        await flush_undelivered(context)
+        await flush_quiet_held(context)
+        started = time.monotonic()
+        results = await run_checks(domains)
+        # Only the global run covers enough of the watchlist to say anything about the API.
+        if trigger == "scheduled" and await handle_api_outage(context, results):
+            # Still count the attempt, so error counts and per-domain due times move on.
+            store.update_statuses(results, datetime.now(timezone.utc).isoformat())
+            return
+        changes, unblocked = record_check(results)
+    duration = time.monotonic() - started
+    CHECKS_TOTAL.labels(trigger=trigger).inc()
+    # Per-domain interval runs come every minute and would rotate the full reports out.
+    if report_keep > 0 and trigger == "scheduled": save_report(results, duration, trigger)
+    if DASHBOARD and trigger == "scheduled": await update_dashboard(context, results, duration)
+    if email_notifier and EMAIL_SCHEDULED and trigger == "scheduled": await email_report(results, duration, trigger)
+    if changes: await notify_changes(context, changes, unblocked, format_run_summary(results, duration))
+    await notify_unblocked(context, unblocked)
+    logger.info(
+        f"Domain check finished, {len(changes)} status changes.",
+        extra={"event": "check_run", "trigger": trigger, "domains": len(domains),
+               "changes": len(changes), "duration_ms": round(duration * 1000)},
+    )
+
+def format_results_json(results: dict, checked_at: str, duration: float) -> str:
+    """Renders results as a JSON document for other tooling; blocked is null where the check failed."""
+    entries = []
+    for domain in report_order(results):
+        result = results[domain]
+        entry = {
+            "domain": domain,
+            "blocked": None if "error" in result else result.get("status", "").lower() == "blocked",
+            "checkedAt": result.get("checked_at") or checked_at,
+        }
+        if "error" in result: entry["error"] = result["error"]
+        else: entry["status"] = result.get("status")
+        if result.get("cached"): entry["cached"] = True
+        entries.append(entry)
+    return json.dumps(
+        {"checkedAt": checked_at, "durationSeconds": round(duration, 1), "results": entries}, indent=2
+    )
+
+def format_report_html(results: dict, duration: float) -> str:
+    """An HTML table of the results for the email report."""
+    rows = []
+    for domain in report_order(results):
+        result = results[domain]
+        if "error" in result: status, color = f"error: {result['error']}", "#b26a00"
+        elif result.get("status", "").lower() == "blocked": status, color = "blocked", "#c62828"
+        else: status, color = "ok", "#2e7d32"
+        rows.append(
+            f'<tr><td>{html.escape(domain)}</td><td style="color:{color}">{html.escape(status)}</td></tr>'
+        )
+    return (
+        "<html><body><h3>Domain Check Results</h3>"
+        '<table border="1" cellpadding="4" cellspacing="0"><tr><th>Domain</th><th>Status</th></tr>'
+        + "".join(rows) + f"</table><p>{html.escape(format_run_summary(results, duration))}</p></body></html>"
+    )
+
+async def email_report(results: dict, duration: float, trigger: str) -> bool:
+    """Emails the verbose report of a run, with an HTML version when EMAIL_HTML is set."""
+    blocked = sum(1 for r in results.values() if "error" not in r and r.get("status", "").lower() == "blocked")
+    subject = f"Domain check ({trigger}): {blocked} of {len(results)} blocked"
+    text = format_report(results, verbose=True) + "\n\n" + format_run_summary(results, duration)
+    return await email_notifier.send_email(subject, text, format_report_html(results, duration) if EMAIL_HTML else None)
+
+def save_report(results: dict, duration: float, trigger: str) -> None:
+    """Writes the verbose report of a scheduled run to REPORT_DIR and drops the oldest beyond report_keep."""
+    now = datetime.now(timezone.utc)
+    text = (
+        f"{trigger} check at {now.isoformat(timespec='seconds')}\n\n"
+        + format_report(results, verbose=True) + "\n\n" + format_run_summary(results, duration) + "\n"
+    )
+    try:
+        write_atomic(REPORT_DIR / f"report-{now.strftime('%Y%m%d-%H%M%S')}.txt", text.encode("utf-8"))
+        rotate_files(REPORT_DIR, "report-*.txt", report_keep)
+    except OSError as e:
+        logger.error(f"Failed to write report to {REPORT_DIR}: {e}")
+
+def format_dashboard(results: dict, duration: float) -> str:
+    """The full report plus when it was taken, cut to fit a single message."""
+    text = (
+        render_report(results) + "\n\n" + format_run_summary(results, duration)
+        + f"\nUpdated: {format_timestamp(datetime.now(timezone.utc).isoformat())}"
+    )
+    if len(text) > TELEGRAM_MESSAGE_LIMIT: text = text[:TELEGRAM_MESSAGE_LIMIT - 2] + "\n…"
+    return text
+
+async def update_dashboard(context: ContextTypes.DEFAULT_TYPE, results: dict, duration: float) -> None:
+    """Edits each chat's dashboard message in place, or sends and pins a new one.
+
+    A new dashboard is sent when there is none yet or the edit fails, e.g. because the
+    message was deleted or is too old to edit.
+    """
+    text = format_dashboard(results, duration)
+    message_ids = store.get_setting("dashboard_messages", {})  # JSON keys, so chat IDs are strings
+    for chat_id in get_notify_chat_ids():
+        message_id = message_ids.get(str(chat_id))
+        await send_rate_limiter.wait(chat_id)
+        if message_id is not None:
+            try:
+                await context.bot.edit_message_text(text, chat_id=chat_id, message_id=message_id)
+                continue
+            except BadRequest as e:
+                if "not modified" in str(e).lower(): continue
+                logger.warning(f"Could not edit dashboard in chat {chat_id}, sending a new one: {e}")
+            except Exception as e:
+                logger.warning(f"Could not edit dashboard in chat {chat_id}: {e}")
+                continue
+        try:
+            message = await context.bot.send_message(
+                chat_id=chat_id, text=text, message_thread_id=notify_thread_id(chat_id)
+            )
+        except Exception as e:
+            logger.error(f"Could not send dashboard to chat {chat_id}: {e}")
+            continue
+        message_ids[str(chat_id)] = message.message_id
+        try:
+            await context.bot.pin_chat_message(chat_id, message.message_id, disable_notification=True)
+        except Exception as e:
+            logger.info(f"Could not pin dashboard in chat {chat_id}: {e}")
+    store.set_setting("dashboard_messages", message_ids)
+
+async def full_check(
+    context: ContextTypes.DEFAULT_TYPE, chat_id: int, verbose: bool = False, tag: str | None = None,
+    output: str = "text", thread_id: int | None = None,
+) -> None:
+    """On-demand check: sends the full report to chat_id and refreshes the stored state.
+
+    When tag is given only domains carrying it are checked. output "json" sends the
+    results as a JSON file and "email" emails the report instead of posting it. Replies
+    go to the forum topic thread_id, if given.
+    """
+    domains, ips = split_ips(store.list_domains(tag, enabled_only=True))
     if not domains:
-        await context.bot.send_message(chat_id=chat_id, text="Watchlist is empty. Add domains with `/add`.")
+        text = f"No enabled domains are tagged {tag}." if tag else "No enabled domains to check. Add domains with `/add`."
+        if ips: text += f"\n{len(ips)} IP addresses are watched, but the API only checks domains."
+        await context.bot.send_message(chat_id=chat_id, text=text, message_thread_id=thread_id)
+        return
+    if check_lock.locked():
+        text = with_icon("⏳", "A check is already running, please wait for it to finish.")
+        await context.bot.send_message(chat_id=chat_id, text=text, message_thread_id=thread_id)
         return
 
-    # Ganti header laporan
-    report_lines = ["Domain Check Results\n"]
-    for domain in domains:
-        result = await check_domain_status(domain)
-        report_lines.append(format_status_message(result, domain))
-        await asyncio.sleep(1)
-        
-    # Kirim pesan tanpa parse_mode, Telegram akan menangani link secara otomatis
-    await context.bot.send_message(chat_id=chat_id, text="\n".join(report_lines))
-    logger.info("Domain check finished and report sent.")
+    started = time.monotonic()
+    async with check_lock:
+        results = await run_checks(domains, use_cache=True)
+        if is_api_outage(results):
+            text = with_icon("🚨", "API unreachable, check skipped") + "\n\n" + format_report(results)
+            await send_long_message(context.bot, chat_id, text, thread_id)
+            return
+        _, unblocked = record_check(results)
+    duration = time.monotonic() - started
+    CHECKS_TOTAL.labels(trigger="manual").inc()
+    if output == "json":
+        now = datetime.now(timezone.utc)
+        await context.bot.send_document(
+            chat_id=chat_id,
+            message_thread_id=thread_id,
+            document=format_results_json(results, now.isoformat(timespec="seconds"), duration).encode("utf-8"),
+            filename=f"check-{now.strftime('%Y%m%d-%H%M%S')}.json",
+            caption=format_run_summary(results, duration),
+        )
+    elif output == "email":
+        sent = await email_report(results, duration, "manual")
+        text = with_icon("📧", f"Report emailed to {len(email_notifier.recipients)} recipients.") if sent else with_icon("❌", "Emailing the report failed, see the logs.")
+        await context.bot.send_message(chat_id=chat_id, text=text, message_thread_id=thread_id)
+    else:
+        # Kirim pesan tanpa parse_mode, Telegram akan menangani link secara otomatis
+        report = render_report(results, verbose) + "\n\n" + format_run_summary(results, duration)
+        if ips: report += "\n" + with_icon("ℹ️", f"{len(ips)} IP addresses not checked: the API only handles domains.")
+        await send_long_message(context.bot, chat_id, report, thread_id)
+    await notify_unblocked(context, unblocked)
+    logger.info(
+        "Domain check finished and report sent.",
+        extra={"event": "check_run", "trigger": "manual", "domains": len(domains),
+               "duration_ms": round(duration * 1000)},
+    )
 
 
 # --- Command Handlers (dengan sedikit penyesuaian gaya) ---
 
+async def log_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    message = update.effective_message
+    if message and message.text and message.text.startswith("/"):
+        command = message.text.split(maxsplit=1)[0]
+        logger.info(
+            f"Command {command} from chat {update.effective_chat.id}",
+            extra={"event": "command", "command": command, "chat_id": update.effective_chat.id},
+        )
+
+# When each unauthorized chat was last answered, so a spammer can't make the bot flood replies.
+unauthorized_replies: dict[int, float] = {}
+
+async def authorize_update(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Runs before every handler and stops updates from chats that are not admins.
+
+    Viewers get through for read-only commands and are told "insufficient permissions"
+    otherwise. Unauthorized chats are told their chat ID, at most once per
+    UNAUTHORIZED_REPLY_INTERVAL.
+    """
+    if not admin_ids: return
+    chat = update.effective_chat
+    if chat is not None and chat.id in admin_ids: return
+    if chat is not None and chat.id in viewer_ids:
+        if viewer_allowed(update): return
+        if update.callback_query is not None:
+            await update.callback_query.answer("Insufficient permissions.", show_alert=True)
+        elif update.effective_message is not None:
+            await update.effective_message.reply_text(with_icon("⛔", "Insufficient permissions: this command needs an admin."))
+        raise ApplicationHandlerStop
+    if chat is not None and update.effective_message is not None:
+        now = time.monotonic()
+        if now - unauthorized_replies.get(chat.id, float("-inf")) >= UNAUTHORIZED_REPLY_INTERVAL:
+            unauthorized_replies[chat.id] = now
+            await update.effective_message.reply_text(f"You are not authorized. Your chat ID is {chat.id}")
+    raise ApplicationHandlerStop
+
+async def whoami_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    await update.message.reply_text(f"Your chat ID is {update.effective_chat.id}")
+
 async def check_now_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    if check_lock.locked():
+        await update.message.reply_text(with_icon("⏳", "A check is already running, please wait for it to finish."))
+        return
     await update.message.reply_text(
         "On-demand check initiated. I will now check all domains on the watchlist..."
     )
-    await periodic_check(context)
+    args = [arg.lower() for arg in context.args or []]
+    output = "json" if "json" in args else "text"
+    await full_check(
+        context, update.effective_chat.id, "verbose" in args, get_tag_argument(context), output, reply_thread_id(update)
+    )
+
+async def email_report_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    if email_notifier is None:
+        await update.message.reply_text("Email is not configured. Set SMTP_HOST, SMTP_FROM and SMTP_TO.")
+        return
+    if check_lock.locked():
+        await update.message.reply_text(with_icon("⏳", "A check is already running, please wait for it to finish."))
+        return
+    await update.message.reply_text(with_icon("📧", "Checking the watchlist, the report will be emailed..."))
+    await full_check(
+        context, update.effective_chat.id, tag=get_tag_argument(context), output="email",
+        thread_id=reply_thread_id(update),
+    )
+
+async def recheck_blocked_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Re-checks only the domains stored as blocked and says which of them recovered."""
+    domains = sorted(d for d, blocked in store.get_statuses().items() if blocked)
+    if not domains:
+        await update.message.reply_text("No domain is currently marked blocked.")
+        return
+    if check_lock.locked():
+        await update.message.reply_text(with_icon("⏳", "A check is already running, please wait for it to finish."))
+        return
+    await update.message.reply_text(with_icon("🔁", f"Re-checking {len(domains)} blocked domains..."))
+    started = time.monotonic()
+    async with check_lock:
+        results = await run_checks(domains)
+        if is_api_outage(results):
+            await update.message.reply_text(with_icon("🚨", "API unreachable, re-check skipped"))
+            return
+        _, unblocked = record_check(results)
+    duration = time.monotonic() - started
+    CHECKS_TOTAL.labels(trigger="recheck_blocked").inc()
+    recovered = [d for d in domains if "error" not in results[d] and results[d].get("status") != "blocked"]
+    still = [d for d in domains if results[d].get("status") == "blocked"]
+    failed = [d for d in domains if "error" in results[d]]
+    lines = [with_icon("🎉", f"Recovered ({len(recovered)})")] + [f"{d}: blocked → clear" for d in recovered]
+    lines += ["", with_icon("🚫", f"Still blocked ({len(still)})")] + still
+    if failed:
+        lines += ["", with_icon("⚠️", f"Errors ({len(failed)})")]
+        lines += [format_status_message(results[d], d) for d in failed]
+    lines += ["", format_run_summary(results, duration)]
+    await reply_long(update, context, "\n".join(lines))
+    await notify_unblocked(context, unblocked)
 
 
 async def start_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
-    data = load_data()
-    data["chat_id"] = update.effective_chat.id
-    save_data(data)
+    store.set_setting("chat_id", update.effective_chat.id)
     
     welcome_text = (
         "Hello! I am a domain status checker.\n\n"
         "**Commands:**\n"
-        "`/add domain1.com ...` - Add domains to watchlist.\n"
-        "`/remove domain1.com ...` - Remove domains.\n"
-        "`/list` - Show all watched domains.\n"
-        "`/checknow` - Trigger an immediate check.\n"
-        "`/check domain.com` - Perform a single check."
+        "`/add [list] domain1.com ... [#tag] [--with-www] [--every 5m] [--priority]` - Add domains to watchlist.\n"
+        "`/remove domain1.com ...` - Remove domains (a unique part of the name is enough).\n"
+        "`/list [#tag] [--by-date]` - Show all watched domains with the date they were added.\n"
+        "`/disable domain.com` / `/enable domain.com` - Pause or resume checking a domain.\n"
+        "`/clear` - Remove every domain (asks for confirmation).\n"
+        "`/search text [N]` - Find watched domains (supports `*` wildcards).\n"
+        "`/export` - Download the watchlist as a CSV file.\n"
+        "`/backup` - Download a dated snapshot of the watchlist.\n"
+        "`/import` - Import domains from an uploaded .txt or .csv file.\n"
+        "`/checknow [verbose|json] [#tag]` - Trigger an immediate check.\n"
+        "`/recheck_blocked` - Re-check only the domains currently blocked.\n"
+        "`/emailreport [#tag]` - Run a check and email the report.\n"
+        "`/status` - Show the last check time and summary.\n"
+        "`/uptime` - Show how long the bot has been running.\n"
+        "`/config` - Show the effective configuration.\n"
+        "`/reload` - Re-read the config file and domain lists.\n"
+        "`/pause` / `/resume` - Stop or restart scheduled checks.\n"
+        "`/setinterval 15m` - Change the check schedule (duration or cron).\n"
+        "`/schedule` - Show the check schedule and the next run times.\n"
+        "`/history domain.com [N]` - Show recent status changes.\n"
+        "`/diff` - Show what changed in the last check.\n"
+        "`/compare a.com b.com` - Show status timelines side by side.\n"
+        "`/problems` - Show domains that keep failing to check.\n"
+        "`/top [N] [30d]` - Show the domains blocked longest recently.\n"
+        "`/stats [N]` - Show blocked counts over the last checks.\n"
+        "`/digest [7d]` - Summarize checks, new blocks and recoveries.\n"
+        "`/check domain.com ...` - Check domains without adding them.\n"
+        "`/dns domain.com` - Compare DNS answers from several resolvers.\n"
+        "`/info domain.com` - Show registrar, expiry and status from RDAP.\n"
+        "`/debug domain.com` - Show the raw API request and response (admins only).\n"
+        "`/ping` - Check that the API is responding and how fast.\n"
+        "`/whoami` - Show your chat ID."
     )
     await update.message.reply_text(welcome_text, parse_mode='Markdown')
 
+# Options accepted by /add, mapped to whether they take a value.
+ADD_FLAGS = {"--with-www": False, "--every": True, "--priority": False, "--no-priority": False}
+ADD_USAGE = (
+    "Usage: /add [list] domain1.com domain2.com [#tag ...] [--with-www] [--every 5m] [--priority|--no-priority]"
+)
+
 async def add_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
     domains_to_process = get_domains_from_message(update.message.text)
     if not domains_to_process:
-        await update.message.reply_text("Usage: /add domain1.com domain2.com")
-        return
-    data = load_data()
-    current_domains = set(data.get("domains", []))
-    domains_to_add = set(domains_to_process)
-    newly_added = sorted(list(domains_to_add - current_domains))
-    already_exist = sorted(list(domains_to_add & current_domains))
-    response_parts = ["Bulk Add Report\n"]
+        await update.message.reply_text(ADD_USAGE)
+        return
+    try:
+        domains_to_process, flags = split_flags(domains_to_process, ADD_FLAGS)
+        domains_to_process, tags = split_tags(domains_to_process)
+    except ValueError as e:
+        await update.message.reply_text(with_icon("❌", str(e)))
+        return
+    # "/add prod example.com" targets the DOMAINS_DIR list named prod.
+    if domains_to_process and domains_to_process[0] in domain_lists:
+        tag = f"#{domains_to_process.pop(0)}"
+        if tag not in tags: tags.append(tag)
+    if not domains_to_process:
+        await update.message.reply_text(ADD_USAGE)
+        return
+    interval = None
+    if "--every" in flags:
+        interval = parse_duration(flags["--every"])
+        if interval is None or 0 < interval < MIN_DOMAIN_INTERVAL:
+            await update.message.reply_text(with_icon("❌", "--every needs a duration of at least 1m, like 5m or 1d (0s resets it)."))
+            return
+    if "--priority" in flags and "--no-priority" in flags:
+        await update.message.reply_text(with_icon("❌", "Use either --priority or --no-priority, not both."))
+        return
+    priority = True if "--priority" in flags else False if "--no-priority" in flags else None
+    report = add_domains_report(
+        "Bulk Add Report", domains_to_process, tags, with_www="--with-www" in flags, interval=interval,
+        priority=priority,
+    )
+    await update.message.reply_text(report)
+
+def add_domains_report(
+    title: str, raw_domains: list[str], tags: list[str] = (), with_www: bool = False, interval: int | None = None,
+    priority: bool | None = None,
+) -> str:
+    """Validates and stores new domains in one write, returning a summary of what happened.
+
+    Tags, a custom check interval (0 resets it to the global schedule) and the priority
+    flag are applied to every valid domain in the input, including ones already on the list.
+    With with_www, each domain's www. variant is added alongside it and the reply lists
+    exactly which domains were added.
+    """
+    current_domains = set(store.list_domains())
+    existing_count = len(current_domains)
+    newly_added, duplicates, rejected, valid = [], 0, [], []
+    for raw in raw_domains:
+        try:
+            domain = validate_domain(raw)
+        except ValueError as e:
+            rejected.append(with_icon("❌", f"{raw}: {e}"))
+            continue
+        variants = [domain]
+        if with_www and not domain.startswith("www.") and not is_ip(domain): variants.append(f"www.{domain}")
+        for variant in variants:
+            if variant not in valid: valid.append(variant)
+            if variant in current_domains:
+                duplicates += 1
+            else:
+                newly_added.append(variant)
+                current_domains.add(variant)
+    if max_domains and existing_count + len(newly_added) > max_domains:
+        return f"{title}\n\n" + with_icon(
+            "❌",
+            f"Not added: {len(newly_added)} new domains would grow the watchlist to "
+            f"{existing_count + len(newly_added)}, above the limit of {max_domains} "
+            f"({max(max_domains - existing_count, 0)} slots left).",
+        )
     if newly_added:
-        data["domains"].extend(newly_added)
-        save_data(data)
-        response_parts.append(f"✅ Added {len(newly_added)} new domains.")
-    if already_exist:
-        response_parts.append(f"☑️ Skipped {len(already_exist)} domains (already on list).")
-    await update.message.reply_text("\n".join(response_parts))
+        store.add_domains(newly_added)
+        logger.info(f"Added {len(newly_added)} domains", extra={"event": "domains_added", "domains": newly_added})
+    summary = f"Added {len(newly_added)}, skipped {duplicates} duplicates, rejected {len(rejected)} invalid"
+    response_parts = [f"{title}\n", summary]
+    if with_www and newly_added:
+        response_parts.append("Added: " + ", ".join(newly_added))
+    if tags and valid:
+        store.add_tags(valid, tags)
+        response_parts.append(with_icon("🏷️", f"Tagged {len(valid)} domains with {' '.join(tags)}"))
+    if interval is not None and valid:
+        store.set_interval(valid, interval or None)
+        if interval: response_parts.append(with_icon("⏱️", f"{len(valid)} domains will be checked every {format_span(interval)}"))
+        else: response_parts.append(with_icon("⏱️", f"{len(valid)} domains follow the global schedule again"))
+    if priority is not None and valid:
+        store.set_priority(valid, priority)
+        if priority: response_parts.append(with_icon("⭐", f"{len(valid)} domains will be checked and reported first"))
+        else: response_parts.append(with_icon("⭐", f"{len(valid)} domains are no longer prioritized"))
+    if rejected:
+        response_parts.append("\nRejected:")
+        response_parts.extend(rejected)
+    return "\n".join(response_parts)
+
+def match_domains(terms: list[str], watchlist: list[str]) -> tuple[list[str], dict[str, list[str]], list[str]]:
+    """Resolves /remove terms against the watchlist.
+
+    An exact match or a substring matching exactly one domain resolves directly.
+    Returns the resolved domains, the candidates for each ambiguous term and the
+    terms that matched nothing.
+    """
+    resolved, ambiguous, not_found = [], {}, []
+    for term in terms:
+        if term in watchlist:
+            resolved.append(term)
+            continue
+        candidates = [d for d in watchlist if term in d]
+        if len(candidates) == 1: resolved.append(candidates[0])
+        elif candidates: ambiguous[term] = candidates
+        else: not_found.append(term)
+    return sorted(set(resolved)), ambiguous, not_found
+
+# Outstanding /remove choices, keyed by a random token embedded in the button data.
+# Each entry holds the requesting user, the candidate domains offered and when (monotonic).
+pending_removals: dict[str, tuple[int, list[str], float]] = {}
+REMOVE_CANDIDATES_LIMIT = 20
+REMOVE_PROMPT_TTL = 300  # seconds a /remove choice can still be answered
 
 async def remove_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
     domains_to_process = get_domains_from_message(update.message.text)
     if not domains_to_process:
         await update.message.reply_text("Usage: /remove domain1.com domain2.com")
         return
-    data = load_data()
-    current_domains = set(data.get("domains", []))
-    domains_to_remove = set(domains_to_process)
-    successfully_removed = sorted(list(domains_to_remove & current_domains))
-    not_found = sorted(list(domains_to_remove - current_domains))
-    response_parts = ["Bulk Remove Report\n"]
-    if successfully_removed:
-        data["domains"] = [d for d in data["domains"] if d not in successfully_removed]
-        save_data(data)
-        response_parts.append(f"✅ Removed {len(successfully_removed)} domains.")
-    if not_found:
-        response_parts.append(f"❓ Could not remove {len(not_found)} domains (not on list).")
-    await update.message.reply_text("\n".join(response_parts))
+    to_remove, ambiguous, not_found = match_domains(domains_to_process, store.list_domains())
+    successfully_removed = store.remove_domains(to_remove)
+    if successfully_removed or not_found:
+        response_parts = ["Bulk Remove Report\n"]
+        if successfully_removed:
+            logger.info(
+                f"Removed {len(successfully_removed)} domains",
+                extra={"event": "domains_removed", "domains": successfully_removed},
+            )
+            response_parts.append(with_icon("✅", f"Removed {len(successfully_removed)} domains: {', '.join(successfully_removed)}"))
+        if not_found:
+            response_parts.append(with_icon("❓", f"Could not remove {len(not_found)} domains (not on list)."))
+        await reply_long(update, context, "\n".join(response_parts))
+    now = time.monotonic()
+    for token in [t for t, p in pending_removals.items() if now - p[2] > REMOVE_PROMPT_TTL]:
+        del pending_removals[token]
+    for term, candidates in ambiguous.items():
+        shown = candidates[:REMOVE_CANDIDATES_LIMIT]
+        token = secrets.token_hex(8)
+        pending_removals[token] = (update.effective_user.id, shown, now)
+        rows = [[InlineKeyboardButton(d, callback_data=f"remove:{token}:{i}")] for i, d in enumerate(shown)]
+        rows.append([InlineKeyboardButton("Cancel", callback_data=f"remove:{token}:no")])
+        text = f"'{term}' matches {len(candidates)} domains. Which one should be removed?"
+        if len(candidates) > len(shown): text += f"\n(Showing the first {len(shown)}; be more specific to narrow it down.)"
+        await update.message.reply_text(text, reply_markup=InlineKeyboardMarkup(rows))
+
+async def remove_callback(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    query = update.callback_query
+    _, token, choice = query.data.split(":", 2)
+    pending = pending_removals.get(token)
+    if pending is not None and time.monotonic() - pending[2] > REMOVE_PROMPT_TTL:
+        del pending_removals[token]
+        pending = None
+    if pending is None or pending[0] != update.effective_user.id:
+        await query.answer("This selection has expired.")
+        if pending is None: await query.edit_message_text(with_icon("⌛", "Selection expired. Send /remove again if needed."))
+        return
+    del pending_removals[token]
+    await query.answer()
+    if choice == "no":
+        await query.edit_message_text("Cancelled, the watchlist was not changed.")
+        return
+    domain = pending[1][int(choice)]
+    if store.remove_domains([domain]):
+        logger.info(f"Removed {domain}", extra={"event": "domains_removed", "domains": [domain]})
+        await query.edit_message_text(with_icon("✅", f"Removed {domain}."))
+    else:
+        await query.edit_message_text(with_icon("❓", f"{domain} is no longer on the list."))
+
+# Outstanding /clear confirmations, keyed by a random token embedded in the button data.
+# Kept in memory only, so buttons from before a restart can never confirm anything.
+pending_clears: dict[str, int] = {}
+
+async def clear_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    count = len(store.list_domains())
+    if not count:
+        await update.message.reply_text("The watchlist is already empty.")
+        return
+    token = secrets.token_hex(8)
+    pending_clears[token] = update.effective_chat.id
+    keyboard = InlineKeyboardMarkup([[
+        InlineKeyboardButton("Yes, delete all", callback_data=f"clear:yes:{token}"),
+        InlineKeyboardButton("Cancel", callback_data=f"clear:no:{token}"),
+    ]])
+    await update.message.reply_text(
+        with_icon("⚠️", f"This will remove all {count} domains from the watchlist. Are you sure?"), reply_markup=keyboard
+    )
+
+async def clear_callback(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    query = update.callback_query
+    _, answer, token = query.data.split(":", 2)
+    chat_id = pending_clears.pop(token, None)
+    if chat_id is None or chat_id != update.effective_chat.id:
+        await query.answer("This confirmation has expired.")
+        await query.edit_message_text(with_icon("⌛", "Confirmation expired. Send /clear again if needed."))
+        return
+    await query.answer()
+    if answer != "yes":
+        await query.edit_message_text("Cancelled, the watchlist was not changed.")
+        return
+    removed = store.clear_domains()
+    logger.info(f"Cleared {removed} domains", extra={"event": "domains_cleared", "count": removed})
+    await query.edit_message_text(with_icon("🗑️", f"Removed all {removed} domains from the watchlist."))
+
+LIST_FLAGS = {"--by-date": False}
+
+def format_added_date(iso_time: str) -> str:
+    return datetime.fromisoformat(iso_time).astimezone(get_display_timezone()).strftime("%Y-%m-%d")
+
+LIST_PAGE_SIZE = 30
+
+def render_list_page(tag: str | None, by_date: bool, page: int) -> tuple[str, InlineKeyboardMarkup | None] | None:
+    """Renders one page of the watchlist with Prev/Next buttons, or None if nothing matches.
+
+    Out-of-range pages are clamped, so buttons on an outdated message still land on a real page.
+    """
+    domains = store.list_domains(tag)
+    if not domains: return None
+    added = {r["domain"]: r["added_at"] for r in store.list_domain_records()}
+    # ISO timestamps sort chronologically; ties keep alphabetical order.
+    if by_date: domains.sort(key=lambda d: added[d])
+    pages = (len(domains) + LIST_PAGE_SIZE - 1) // LIST_PAGE_SIZE
+    page = max(0, min(page, pages - 1))
+    tags = store.get_tags()
+    disabled = store.get_disabled()
+    intervals = store.get_intervals()
+    priority = store.get_priority()
+    # Tampilkan daftar sebagai list URL sederhana
+    message_domains = [
+        " ".join(
+            [f"https://{d}/ (added {format_added_date(added[d])})"]
+            + ([with_icon("⭐", "priority")] if d in priority else [])
+            + ([with_icon("🔢", "IP, not checked")] if is_ip(d) else [])
+            + ([with_icon("⏸️", "disabled")] if d in disabled else [])
+            + ([with_icon("⏱️", f"every {format_span(intervals[d])}")] if d in intervals else [])
+            + tags.get(d, [])
+        )
+        for d in domains[page * LIST_PAGE_SIZE:(page + 1) * LIST_PAGE_SIZE]
+    ]
+    title = with_icon("📋", f"Current Watchlist ({tag}):" if tag else "Current Watchlist:")
+    if pages > 1: title += f" page {page + 1}/{pages}, {len(domains)} domains"
+    # Only pathologically long names and tag lists can overflow a page; cut rather than fail.
+    text = split_message(title + "\n" + "\n".join(message_domains))[0]
+    if pages == 1: return text, None
+    # Callback data carries the whole view so any page can be rendered without server-side state.
+    view = f"{tag or '-'}:{int(by_date)}"
+    buttons = []
+    if page > 0: buttons.append(InlineKeyboardButton(with_icon("◀️", "Prev"), callback_data=f"list:{page - 1}:{view}"))
+    if page < pages - 1: buttons.append(InlineKeyboardButton("Next ▶️" if USE_EMOJI else "Next", callback_data=f"list:{page + 1}:{view}"))
+    return text, InlineKeyboardMarkup([buttons])
 
 async def list_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
-    domains = load_data().get("domains", [])
-    if not domains:
+    try:
+        _, flags = split_flags(context.args or [], LIST_FLAGS)
+    except ValueError as e:
+        await update.message.reply_text(with_icon("❌", str(e)))
+        return
+    tag = get_tag_argument(context)
+    rendered = render_list_page(tag, "--by-date" in flags, 0)
+    if rendered is None:
+        if tag: await update.message.reply_text(f"No domains are tagged {tag}.")
+        else: await update.message.reply_text("The watchlist is empty. Use `/add domain.com`.")
+        return
+    text, keyboard = rendered
+    await update.message.reply_text(text, reply_markup=keyboard)
+
+async def list_callback(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    query = update.callback_query
+    _, page, tag, by_date = query.data.split(":", 3)
+    await query.answer()
+    rendered = render_list_page(None if tag == "-" else tag, by_date == "1", int(page))
+    if rendered is None:
+        await query.edit_message_text("The watchlist is empty. Use `/add domain.com`.")
+        return
+    text, keyboard = rendered
+    await query.edit_message_text(text, reply_markup=keyboard)
+
+async def set_enabled_command(update: Update, context: ContextTypes.DEFAULT_TYPE, enabled: bool) -> None:
+    command = "enable" if enabled else "disable"
+    domains_to_process = get_domains_from_message(update.message.text)
+    if not domains_to_process:
+        await update.message.reply_text(f"Usage: /{command} domain1.com domain2.com")
+        return
+    watchlist = set(store.list_domains())
+    not_found = sorted(set(d for d in domains_to_process if d not in watchlist))
+    changed = store.set_enabled([d for d in domains_to_process if d in watchlist], enabled)
+    if changed:
+        logger.info(f"{command.capitalize()}d {len(changed)} domains", extra={"event": f"domains_{command}d", "domains": changed})
+    parts = []
+    if changed:
+        label = with_icon("▶️", "Enabled") if enabled else with_icon("⏸️", "Disabled")
+        parts.append(f"{label} {', '.join(changed)}.")
+    unchanged = len(set(domains_to_process)) - len(changed) - len(not_found)
+    if unchanged: parts.append(f"{unchanged} domains were already {command}d.")
+    if not_found: parts.append(with_icon("❓", f"Not on the list: {', '.join(not_found)}"))
+    await update.message.reply_text("\n".join(parts))
+
+async def enable_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    await set_enabled_command(update, context, True)
+
+async def disable_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    await set_enabled_command(update, context, False)
+
+async def export_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    records = store.list_domain_records()
+    if not records:
         await update.message.reply_text("The watchlist is empty. Use `/add domain.com`.")
         return
-    # Tampilkan daftar sebagai list URL sederhana
-    message_domains = [f"https://{d}/" for d in domains]
-    message = "📋 Current Watchlist:\n" + "\n".join(message_domains)
-    await update.message.reply_text(message)
+    await update.message.reply_document(
+        document=format_export(records).encode("utf-8"),
+        filename="domains.txt",
+        caption=with_icon("📋", f"{len(records)} domains"),
+    )
+
+async def import_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    await update.message.reply_text(
+        "Send me a .txt or .csv file (max 1 MB) with one domain per line. Lines starting with # are ignored."
+    )
+
+async def import_document(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    document = update.message.document
+    filename = (document.file_name or "").lower()
+    if not filename.endswith((".txt", ".csv")):
+        await update.message.reply_text("To import domains, send a .txt or .csv file with one domain per line.")
+        return
+    if document.file_size and document.file_size > IMPORT_MAX_BYTES:
+        await update.message.reply_text(with_icon("❌", f"File is too large (limit is {IMPORT_MAX_BYTES // 1024} KB)."))
+        return
+    try:
+        file = await document.get_file()
+        content = (await file.download_as_bytearray()).decode("utf-8-sig")
+    except UnicodeDecodeError:
+        await update.message.reply_text(with_icon("❌", "File must be UTF-8 text."))
+        return
+    except Exception as e:
+        logger.error(f"Failed to download import file {filename}: {e}")
+        await update.message.reply_text(with_icon("❌", "Could not download the file, please try again."))
+        return
+    domains = parse_import_file(content)
+    if not domains:
+        await update.message.reply_text("No domains found in the file.")
+        return
+    await update.message.reply_text(add_domains_report("Import Report", domains))
+
+async def backup_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    records = store.list_domain_records()
+    if not records:
+        await update.message.reply_text("The watchlist is empty, nothing to back up.")
+        return
+    now = datetime.now(get_display_timezone())
+    filename = f"domains-{now.strftime('%Y-%m-%d')}.txt"
+    content = format_export(records).encode("utf-8")
+    if backup_keep > 0:
+        try:
+            write_atomic(BACKUP_DIR / f"domains-{now.strftime('%Y%m%d-%H%M%S')}.txt", content)
+            rotate_files(BACKUP_DIR, "domains-*.txt", backup_keep)
+        except OSError as e:
+            logger.error(f"Failed to write backup to {BACKUP_DIR}: {e}")
+    await update.message.reply_document(
+        document=content, filename=filename, caption=with_icon("💾", f"Backup of {len(records)} domains")
+    )
+
+async def search_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    if not args or len(args) > 2 or (len(args) == 2 and not args[1].isdigit()):
+        await update.message.reply_text("Usage: /search text [N] (use * as a wildcard, e.g. *.co.id)")
+        return
+    limit = max(1, int(args[1])) if len(args) == 2 else SEARCH_DEFAULT_COUNT
+    matches = store.search_domains(args[0], limit)
+    if not matches:
+        await update.message.reply_text(f"No domains match '{args[0]}'.")
+        return
+    lines = [with_icon("🔎", f"{len(matches)} domains matching '{args[0]}':")]
+    for match in matches:
+        status = match["last_status"]
+        label = "unchecked" if status is None else status_label(status == "blocked")
+        lines.append(f"{match['domain']} — {label}")
+    await reply_long(update, context, "\n".join(lines))
 
 async def check_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
-    domains_to_check = get_domains_from_message(update.message.text)
+    """Ad-hoc lookup that never touches the stored watchlist or status."""
+    raw_domains = get_domains_from_message(update.message.text)
+    if not raw_domains:
+        await update.message.reply_text("Usage: /check domain.com [domain2.com ...]")
+        return
+    if len(raw_domains) > CHECK_COMMAND_LIMIT:
+        await update.message.reply_text(with_icon("❌", f"You can check at most {CHECK_COMMAND_LIMIT} domains at once."))
+        return
+    domains_to_check, rejected = [], []
+    for raw in raw_domains:
+        try:
+            domain = validate_domain(raw)
+        except ValueError as e:
+            rejected.append(with_icon("❌", f"{raw}: {e}"))
+            continue
+        if domain not in domains_to_check: domains_to_check.append(domain)
+    domains_to_check, ips = split_ips(domains_to_check)
+    rejected += [with_icon("ℹ️", f"{ip}: not checked, the API only handles domains") for ip in ips]
     if not domains_to_check:
-        await update.message.reply_text("Usage: /check domain.com")
+        await update.message.reply_text("\n".join(rejected))
+        return
+    await update.message.reply_text(with_icon("🔍", f"Checking {', '.join(domains_to_check)}..."))
+    results = await run_checks(domains_to_check, use_cache=True)
+    lines = [format_status_message(result, domain) for domain, result in results.items()]
+    await reply_long(update, context, "\n".join(lines + rejected))
+
+DEBUG_BODY_LIMIT = 1500  # characters of raw API response shown by /debug
+PING_DOMAIN = os.getenv("PING_DOMAIN", "google.com")  # known-good domain /ping checks
+
+async def debug_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Shows the exact API request for a domain and the raw response, for diagnosing API quirks."""
+    if not admin_ids:
+        await update.message.reply_text("/debug is only available when ADMIN_CHAT_ID is set.")
+        return
+    args = context.args or []
+    if len(args) != 1:
+        await update.message.reply_text("Usage: /debug domain.com")
+        return
+    try:
+        domain = validate_domain(args[0])
+    except ValueError as e:
+        await update.message.reply_text(with_icon("❌", f"{args[0]}: {e}"))
+        return
+    if not hasattr(checker, "fetch_raw"):
+        await update.message.reply_text(f"The {CHECK_BACKEND} backend does not support /debug.")
+        return
+    try:
+        url, status_code, body = await checker.fetch_raw(domain)
+    except requests.RequestException as e:
+        await update.message.reply_text(f"Request for {domain} failed before a response: {e}")
+        return
+    if len(body) > DEBUG_BODY_LIMIT: body = body[:DEBUG_BODY_LIMIT] + f"… ({len(body)} characters in total)"
+    await update.message.reply_text(with_icon("🐞", f"{url}\nHTTP {status_code}\n\n{body or '(empty body)'}"))
+
+async def ping_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Sends one request for PING_DOMAIN and reports whether the API answered and how fast."""
+    if not hasattr(checker, "fetch_raw"):
+        await update.message.reply_text(f"The {CHECK_BACKEND} backend does not support /ping.")
+        return
+    started = time.monotonic()
+    try:
+        _, status_code, body = await checker.fetch_raw(PING_DOMAIN)
+    except requests.RequestException as e:
+        elapsed = (time.monotonic() - started) * 1000
+        await update.message.reply_text(with_icon("🔴", f"API not responding after {elapsed:.0f} ms: {e}"))
+        return
+    elapsed = (time.monotonic() - started) * 1000
+    healthy = 200 <= status_code < 300 and body.strip() not in ("", "{}")
+    icon, verdict = ("🟢", "API is responding") if healthy else ("🟠", "API answered with a problem")
+    await update.message.reply_text(with_icon(icon, f"{verdict}\nHTTP {status_code} in {elapsed:.0f} ms ({PING_DOMAIN})"))
+
+async def info_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    if len(args) != 1:
+        await update.message.reply_text("Usage: /info domain.com")
+        return
+    try:
+        domain = validate_domain(args[0])
+    except ValueError as e:
+        await update.message.reply_text(with_icon("❌", f"{args[0]}: {e}"))
+        return
+    try:
+        info = await rdap_lookup(domain)
+    except RDAPError as e:
+        await update.message.reply_text(with_icon("ℹ️", f"No registration data for {domain}: {e}"))
+        return
+    if info["expires_at"]: store.set_expiry(domain, info["expires_at"])
+    expires = format_timestamp(info["expires_at"]) if info["expires_at"] else "unknown"
+    lines = [
+        with_icon("ℹ️", f"Registration info for {domain}\n"),
+        f"Registrar: {info['registrar'] or 'unknown'}",
+        f"Expires: {expires}",
+        f"Status: {', '.join(info['status']) or 'unknown'}",
+    ]
+    await update.message.reply_text("\n".join(lines))
+
+async def dns_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    if len(args) != 1:
+        await update.message.reply_text("Usage: /dns domain.com")
+        return
+    try:
+        domain = validate_domain(args[0])
+    except ValueError as e:
+        await update.message.reply_text(with_icon("❌", f"{args[0]}: {e}"))
+        return
+    answers = await compare_resolvers(domain)
+    await update.message.reply_text(format_dns_report(domain, answers))
+
+async def pause_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    global check_job
+    if check_job is None:
+        await update.message.reply_text("Scheduled checks are already paused.")
+        return
+    check_job.schedule_removal()
+    check_job = None
+    store.set_setting("paused", True)
+    logger.info("Scheduled checks paused", extra={"event": "paused"})
+    await update.message.reply_text(with_icon("⏸️", "Scheduled checks paused. Use /resume to start them again."))
+
+async def resume_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    global check_job
+    if check_job is not None:
+        await update.message.reply_text("Scheduled checks are already running.")
+        return
+    check_job = schedule_checks(context.job_queue, check_schedule)
+    store.set_setting("paused", False)
+    logger.info("Scheduled checks resumed", extra={"event": "resumed"})
+    await update.message.reply_text(with_icon("▶️", f"Scheduled checks resumed ({check_schedule})."))
+
+async def setinterval_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    parts = update.message.text.split(maxsplit=1)
+    if len(parts) < 2:
+        await update.message.reply_text(
+            f"Usage: /setinterval 15m or /setinterval */10 * * * *\nCurrent schedule: {check_schedule}"
+        )
+        return
+    spec = parts[1].strip()
+    try:
+        reschedule(context.job_queue, spec)
+    except ValueError as e:
+        await update.message.reply_text(with_icon("❌", f"{e}\nThe schedule was not changed ({check_schedule})."))
+        return
+    logger.info(f"Check schedule changed to '{spec}'", extra={"event": "rescheduled", "schedule": spec})
+    suffix = " Checks are paused; it applies on /resume." if check_job is None else ""
+    await update.message.reply_text(with_icon("⏱️", f"Check schedule set to {spec}.{suffix}"))
+
+async def schedule_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    kind = "interval" if isinstance(parse_schedule(check_schedule), int) else "cron, UTC"
+    lines = [with_icon("⏱️", f"Schedule: {check_schedule} ({kind})")]
+    if check_job is None:
+        lines.append("Scheduled checks are paused. Use /resume to start them again.")
+    else:
+        tz = get_display_timezone()
+        lines.append("Next runs:")
+        lines += [t.astimezone(tz).strftime("%Y-%m-%d %H:%M %Z") for t in next_run_times(check_schedule)]
+    await update.message.reply_text("\n".join(lines))
+
+def mask_id(chat_id: int) -> str:
+    """Keeps the first and last two digits of a chat ID, e.g. 12*****89."""
+    text = str(chat_id)
+    return text if len(text) <= 4 else text[:2] + "*" * (len(text) - 4) + text[-2:]
+
+def effective_config() -> dict[str, str]:
+    """The settings in effect after parsing, for /config. Secrets are masked or only reported as set."""
+    return {
+        "Config file": f"{CONFIG_FILE} ({len(config_file_keys)} settings)" if config_file_keys else "none",
+        "Mode": BOT_MODE,
+        "Schedule": f"{check_schedule} ({'paused' if check_job is None else 'active'})",
+        "Backend": CHECK_BACKEND,
+        "API base URL": INDIWTF_API_BASE_URL,
+        "API method": getattr(checker, "method", API_METHOD),
+        "API token": "set" if INDIWTF_TOKEN else "missing",
+        "API proxy": "set" if API_PROXY else "none",
+        "Telegram proxy": "set" if TELEGRAM_PROXY else "none",
+        "HTTP timeout": f"{http_timeout:g}s",
+        "Check deadline": f"{check_deadline:g}s",
+        "API delay": f"{api_rate_limiter.interval:g}s",
+        "Concurrency": str(check_concurrency),
+        "Admin IDs": ", ".join(mask_id(i) for i in sorted(admin_ids)) or "none (legacy /start chat)",
+        "Viewer IDs": ", ".join(mask_id(i) for i in sorted(viewer_ids)) or "none",
+        "Max domains": str(max_domains or "unlimited"),
+        "Notify cooldown": f"{notify_cooldown}s",
+        "Result cache TTL": f"{result_cache_ttl}s",
+        "Quiet hours": QUIET_HOURS if quiet_hours else "off",
+        "Expiry warnings": f"{expiry_warn_days} days ahead" if expiry_warn_days else "off",
+        "Display timezone": TZ_DISPLAY,
+        "Report template": "custom" if report_template else "built-in",
+        "Emoji": "on" if USE_EMOJI else "off",
+        "Dashboard": "on" if DASHBOARD else "off",
+        "Digest": f"{DIGEST_SCHEDULE} covering {DIGEST_WINDOW}" if DIGEST_SCHEDULE else "off",
+        "Notifiers": ", ".join(type(n).__name__.removesuffix("Notifier").lower() for n in notifiers),
+        "Topic": MESSAGE_THREAD_ID or "none",
+        "Status webhook": "set" if STATUS_WEBHOOK_URL else "none",
+        "Email": f"{SMTP_HOST}:{smtp_port} ({SMTP_SECURITY})" if SMTP_HOST else "off",
+        "Saved reports": f"last {report_keep} in {REPORT_DIR}" if report_keep > 0 else "off",
+        "Debug logging": "on" if BOT_DEBUG else "off",
+        "Log format": LOG_FORMAT,
+    }
+
+# Settings /reload can change at runtime; everything else is only read at startup.
+RELOADABLE_SETTINGS = (
+    "CHECK_SCHEDULE", "API_DELAY", "HTTP_TIMEOUT", "CHECK_DEADLINE", "NOTIFY_COOLDOWN", "RESULT_CACHE_TTL",
+    "QUIET_HOURS", "DNS_RESOLVERS", "ADMIN_CHAT_ID", "VIEWER_CHAT_IDS", "REPORT_TEMPLATE", "REPORT_TEMPLATE_FILE",
+)
+
+def reload_settings() -> tuple[list[str], list[str]]:
+    """Re-reads CONFIG_FILE, validates the result and applies it.
+
+    Real env vars still win over the file. Returns the settings that changed and notes
+    about ones that need a restart. Raises ValueError or ConfigError and leaves the
+    running config untouched if the file or the merged config is invalid.
+    """
+    settings = read_config_file(CONFIG_FILE) if CONFIG_FILE.exists() else {}
+    changed, notes, previous = [], [], {}
+    for key in sorted(set(settings) | config_file_keys):
+        if key in os.environ and key not in config_file_keys: continue  # real env var
+        if key not in settings:
+            notes.append(f"{key} was removed from the file; restart to return to its default.")
+        elif settings[key] != os.environ.get(key):
+            if key in RELOADABLE_SETTINGS: changed.append(key)
+            else: notes.append(f"{key} changed; it only takes effect after a restart.")
+    for key in changed:
+        previous[key] = (os.environ.get(key), globals()[key])
+        os.environ[key] = globals()[key] = settings[key]
+    try:
+        config = load_config()
+    except ConfigError:
+        for key, (env_value, value) in previous.items():
+            if env_value is None: os.environ.pop(key, None)
+            else: os.environ[key] = env_value
+            globals()[key] = value
+        raise
+    config_file_keys.update(changed)
+    apply_config(config)
+    return changed, notes
+
+async def reload_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Re-reads CONFIG_FILE and DOMAINS_DIR without a restart and reports what changed."""
+    global domain_lists
+    if check_lock.locked():
+        await update.message.reply_text(with_icon("⏳", "A check is running, /reload again once it has finished."))
+        return
+    async with check_lock:
+        try:
+            changed, notes = reload_settings()
+        except (ValueError, ConfigError) as e:
+            await update.message.reply_text(with_icon("❌", f"Reload failed, nothing was changed:\n{e}"))
+            return
+        lines = [with_icon("🔄", "Reloaded")]
+        lines += [f"{key} = {os.environ[key]}" for key in changed] or ["No setting changed."]
+        if "CHECK_SCHEDULE" in changed:
+            try:
+                reschedule(context.job_queue, CHECK_SCHEDULE)
+                lines.append(with_icon("⏱️", f"Check schedule is now {CHECK_SCHEDULE}."))
+            except ValueError as e:
+                lines.append(with_icon("❌", f"Schedule not changed: {e}"))
+        if "QUIET_HOURS" in changed: schedule_quiet_end(context.job_queue)
+        if DOMAINS_DIR:
+            domain_lists, added, removed = import_domain_lists(Path(DOMAINS_DIR))
+            lines.append(
+                with_icon("📋", f"Reloaded {len(domain_lists)} domain lists, {len(added)} new and {len(removed)} removed domains.")
+            )
+            if added: lines.append(with_icon("➕", ", ".join(added)))
+            if removed: lines.append(with_icon("➖", ", ".join(removed)))
+        lines += notes
+    logger.info("Configuration reloaded", extra={"event": "reloaded", "changed": changed})
+    await reply_long(update, context, "\n".join(lines))
+
+async def config_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    lines = [with_icon("⚙️", "Effective configuration\n")] + [f"{k}: {v}" for k, v in effective_config().items()]
+    await update.message.reply_text("\n".join(lines))
+
+# When this process started, set in main(); /uptime makes unexpected restarts visible.
+started_at: datetime | None = None
+
+def format_uptime() -> str:
+    """Renders the time since start in full, e.g. "up 3d 4h 12m"."""
+    minutes = int((datetime.now(timezone.utc) - started_at).total_seconds() // 60)
+    days, minutes = divmod(minutes, 24 * 60)
+    hours, minutes = divmod(minutes, 60)
+    parts = ([f"{days}d"] if days else []) + ([f"{hours}h"] if days or hours else []) + [f"{minutes}m"]
+    return "up " + " ".join(parts)
+
+async def uptime_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    await update.message.reply_text(with_icon("⏱️", f"{format_uptime()} (since {format_timestamp(started_at.isoformat())})"))
+
+async def status_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    state_line = "Scheduled checks: " + ("paused" if check_job is None else "active")
+    state_line += f"\nBot: {format_uptime()}"
+    status = store.get_setting("last_check")
+    if not status:
+        await update.message.reply_text(f"No check has run yet. Use /checknow to run one.\n{state_line}")
+        return
+    message = (
+        f"{state_line}\n"
+        f"Last check: {format_timestamp(status['time'])}\n"
+        f"Tracked: {len(store.list_domains())}\n"
+        f"Blocked: {status.get('blocked', 0)}\n"
+        f"Clear: {status.get('clear', 0)}"
+    )
+    await update.message.reply_text(message)
+
+async def stats_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    if len(args) > 1 or (args and not args[0].isdigit()):
+        await update.message.reply_text("Usage: /stats [N]")
+        return
+    points = max(1, min(int(args[0]) if args else stats_points, CHECK_RUNS_LIMIT))
+    runs = store.get_check_runs(points)
+    if not runs:
+        await update.message.reply_text("No check has run yet. Use /checknow to run one.")
+        return
+    lines = [with_icon("📈", f"Blocked domains, last {len(runs)} checks"), sparkline([r["blocked"] for r in runs]), ""]
+    for run in runs:
+        lines.append(f"{format_timestamp(run['checked_at'])}  {run['blocked']:>4} / {run['total']}")
+    await reply_long(update, context, "\n".join(lines))
+
+def diff_statuses(previous: dict[str, bool], current: dict[str, bool]) -> tuple[list[str], list[str], int]:
+    """Returns the newly blocked and newly cleared domains and how many kept their status.
+
+    Domains missing from either snapshot are left out.
+    """
+    blocked, cleared, unchanged = [], [], 0
+    for domain in sorted(current):
+        if domain not in previous: continue
+        if current[domain] == previous[domain]: unchanged += 1
+        elif current[domain]: blocked.append(domain)
+        else: cleared.append(domain)
+    return blocked, cleared, unchanged
+
+async def diff_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    previous = store.get_setting("previous_statuses")
+    if not previous:
+        await update.message.reply_text("No baseline yet. Run /checknow to record one.")
+        return
+    blocked, cleared, unchanged = diff_statuses(previous, store.get_statuses())
+    lines = [with_icon("🔀", "Changes since the previous check\n"), with_icon("🚫", f"Newly blocked ({len(blocked)})")]
+    lines.extend(blocked)
+    lines.append("\n" + with_icon("✅", f"Newly cleared ({len(cleared)})"))
+    lines.extend(cleared)
+    lines.append("\n" + with_icon("➖", f"Unchanged: {unchanged}"))
+    await reply_long(update, context, "\n".join(lines))
+
+def rank_blocked(history: list[sqlite3.Row], since: datetime, now: datetime) -> list[tuple[str, float, int]]:
+    """Totals blocked time and block events per domain between since and now.
+
+    Returns (domain, blocked seconds, block events) for domains blocked at some
+    point in the window, most time blocked first.
+    """
+    totals: dict[str, list] = {}
+    by_domain: dict[str, list[sqlite3.Row]] = {}
+    for row in history: by_domain.setdefault(row["domain"], []).append(row)
+    for domain, rows in by_domain.items():
+        seconds, events, blocked_from = 0.0, 0, None
+        for row in rows:
+            at = datetime.fromisoformat(row["changed_at"])
+            if row["status"] == "blocked":
+                if blocked_from is None: blocked_from = at
+                if at >= since: events += 1
+            elif blocked_from is not None:
+                seconds += max(0.0, (at - max(blocked_from, since)).total_seconds())
+                blocked_from = None
+        if blocked_from is not None: seconds += (now - max(blocked_from, since)).total_seconds()
+        if seconds > 0 or events: totals[domain] = [seconds, events]
+    return sorted(((d, t[0], t[1]) for d, t in totals.items()), key=lambda x: (-x[1], -x[2], x[0]))
+
+def summarize_window(history: list[sqlite3.Row], current: dict[str, bool], since: datetime) -> tuple[list[str], list[str], int]:
+    """Compares each domain's status at since with its current one.
+
+    Returns the domains blocked now but not then (net new blocks), the ones blocked
+    then but clear now (net recoveries) and how many block events happened in between.
+    """
+    at_start: dict[str, str] = {}
+    events = 0
+    for row in history:  # oldest first per domain, so later rows overwrite earlier ones
+        if datetime.fromisoformat(row["changed_at"]) <= since: at_start[row["domain"]] = row["status"]
+        elif row["status"] == "blocked": events += 1
+    new_blocks = sorted(d for d, blocked in current.items() if blocked and at_start.get(d) != "blocked")
+    recoveries = sorted(d for d, blocked in current.items() if not blocked and at_start.get(d) == "blocked")
+    return new_blocks, recoveries, events
+
+def build_digest(window: int) -> str:
+    """Summarizes the last window seconds: check runs, net new blocks, net recoveries and what is blocked now."""
+    now = datetime.now(timezone.utc)
+    since = now - timedelta(seconds=window)
+    current = store.get_statuses()
+    new_blocks, recoveries, events = summarize_window(store.get_all_history(), current, since)
+    runs = store.count_check_runs(since.isoformat())
+    blocked_now = sorted(d for d, b in current.items() if b)
+    lines = [
+        with_icon("🗞️", f"Digest for the last {format_span(window)}") + "\n",
+        f"Checks run: {runs}",
+        f"Block events: {events}",
+        f"Net new blocks: {len(new_blocks)}" + (f" ({', '.join(new_blocks)})" if new_blocks else ""),
+        f"Net recoveries: {len(recoveries)}" + (f" ({', '.join(recoveries)})" if recoveries else ""),
+        "",
+        f"Blocked now ({len(blocked_now)} of {len(current)}):" if blocked_now else f"Nothing blocked now ({len(current)} domains).",
+    ]
+    lines.extend(blocked_now)
+    return "\n".join(lines)
+
+async def digest_job(context: ContextTypes.DEFAULT_TYPE) -> None:
+    await notify(context, build_digest(parse_duration(DIGEST_WINDOW)))
+
+async def digest_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    window = parse_duration(args[0]) if len(args) == 1 else parse_duration(DIGEST_WINDOW) if not args else None
+    if not window:
+        await update.message.reply_text("Usage: /digest [window, e.g. 7d]")
+        return
+    await reply_long(update, context, build_digest(window))
+
+def format_span(seconds: float) -> str:
+    """Renders a duration coarsely, e.g. "3d 4h" or "25m"."""
+    minutes = int(seconds // 60)
+    days, minutes = divmod(minutes, 24 * 60)
+    hours, minutes = divmod(minutes, 60)
+    if days: return f"{days}d {hours}h"
+    if hours: return f"{hours}h {minutes}m"
+    return f"{minutes}m"
+
+async def top_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    count, window = top_default_count, parse_duration(TOP_DEFAULT_WINDOW) or 30 * 86400
+    for arg in args:
+        if arg.isdigit(): count = max(1, int(arg))
+        elif parse_duration(arg): window = parse_duration(arg)
+        else:
+            await update.message.reply_text("Usage: /top [N] [window, e.g. 7d]")
+            return
+    now = datetime.now(timezone.utc)
+    ranking = rank_blocked(store.get_all_history(), now - timedelta(seconds=window), now)[:count]
+    if not ranking:
+        await update.message.reply_text("No domain was blocked in that window.")
+        return
+    lines = [with_icon("🏆", f"Most blocked domains, last {format_span(window)}\n")]
+    for i, (domain, seconds, events) in enumerate(ranking, 1):
+        lines.append(f"{i}. {domain} - blocked {format_span(seconds)}, {events} block events")
+    await update.message.reply_text("\n".join(lines))
+
+async def problems_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    rows = store.list_problems(problem_threshold)
+    if not rows:
+        await update.message.reply_text(f"No domain has failed {problem_threshold} checks in a row.")
+        return
+    lines = [with_icon("🩺", f"Domains failing {problem_threshold}+ checks in a row\n")]
+    lines += [f"{r['domain']} - {r['error_count']} failures, last: {r['last_error']}" for r in rows]
+    lines.append("\nFix or /remove them; a successful check clears the count.")
+    await reply_long(update, context, "\n".join(lines))
+
+async def history_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    if not args or len(args) > 2 or (len(args) == 2 and not args[1].isdigit()):
+        await update.message.reply_text("Usage: /history domain.com [N]")
+        return
+    try:
+        domain = validate_domain(args[0])
+    except ValueError as e:
+        await update.message.reply_text(with_icon("❌", f"{args[0]}: {e}"))
+        return
+    count = min(int(args[1]), HISTORY_LIMIT) if len(args) == 2 else HISTORY_DEFAULT_COUNT
+    entries = store.get_history(domain, max(count, 1))
+    if not entries:
+        await update.message.reply_text(f"No status history for {domain} yet.")
         return
-    domain_to_check = domains_to_check[0]
-    await update.message.reply_text(f"🔍 Checking {domain_to_check}...")
-    result = await check_domain_status(domain_to_check)
-    await update.message.reply_text(format_status_message(result, domain_to_check))
+    lines = [with_icon("📜", f"History for {domain}\n")]
+    for entry in entries:
+        label = status_label(entry["status"] == "blocked")
+        lines.append(f"{label} at {format_timestamp(entry['changed_at'])}")
+    await update.message.reply_text("\n".join(lines))
+
+COMPARE_LIMIT = 4  # domains per /compare
+COMPARE_ROWS = 15  # most recent status changes shown by /compare
+
+def format_comparison(histories: dict[str, list]) -> str:
+    """Lays the status timelines of several domains side by side, newest change first.
+
+    Each row is a moment one of the domains changed status and shows what every domain
+    was at that moment; "-" means no status was recorded yet.
+    """
+    events = sorted({e["changed_at"] for entries in histories.values() for e in entries}, reverse=True)[:COMPARE_ROWS]
+    tz = get_display_timezone()
+    widths = [max(len(d), len("BLOCKED*")) for d in histories]
+    header = "time".ljust(13) + "  ".join(d.ljust(w) for d, w in zip(histories, widths)).rstrip()
+    rows = [header, "-" * len(header)]
+    for at in events:
+        cells = []
+        for (domain, entries), width in zip(histories.items(), widths):
+            # History is newest first, so the first entry at or before this moment is the status then.
+            status = next((e["status"] for e in entries if e["changed_at"] <= at), None)
+            cell = "-" if status is None else "BLOCKED" if status == "blocked" else "ok"
+            if any(e["changed_at"] == at for e in entries): cell += "*"
+            cells.append(cell.ljust(width))
+        rows.append((datetime.fromisoformat(at).astimezone(tz).strftime("%m-%d %H:%M") + "  " + "  ".join(cells)).rstrip())
+    return "\n".join(rows)
+
+async def compare_command(update: Update, context: ContextTypes.DEFAULT_TYPE) -> None:
+    args = context.args or []
+    if not 2 <= len(args) <= COMPARE_LIMIT:
+        await update.message.reply_text(f"Usage: /compare a.com b.com (up to {COMPARE_LIMIT} domains)")
+        return
+    histories = {}
+    for arg in args:
+        try:
+            domain = validate_domain(arg)
+        except ValueError as e:
+            await update.message.reply_text(with_icon("❌", f"{arg}: {e}"))
+            return
+        histories[domain] = store.get_history(domain, HISTORY_LIMIT)
+    if not any(histories.values()):
+        await update.message.reply_text("No status history for these domains yet.")
+        return
+    table = format_comparison(histories)
+    # HTML rather than Markdown: the * change markers and a "_" in TZ_DISPLAY would otherwise be parsed.
+    await update.message.reply_text(
+        with_icon("🔀", f"Status timelines ({html.escape(TZ_DISPLAY)}), * marks a change\n<pre>{html.escape(table)}</pre>"),
+        parse_mode="HTML",
+    )
+
+async def send_startup_message(context: ContextTypes.DEFAULT_TYPE) -> None:
+    """Tells admins the bot is up, how many domains were loaded and when the next check runs."""
+    if check_job is None:
+        next_line = "Scheduled checks are paused."
+    else:
+        next_t = getattr(check_job, "next_t", None)
+        next_line = f"Next check: {format_timestamp(next_t.isoformat())}" if next_t else "Next check: unknown"
+    await broadcast(context, with_icon("✅", "Bot started.") + f"\nWatching {len(store.list_domains())} domains.\n{next_line}")
+
+# --- Dry Run ---
+class DryRunBot:
+    """Stands in for telegram.Bot in DRY_RUN mode and prints messages instead of sending them."""
+
+    async def send_message(self, chat_id: int, text: str, **kwargs) -> None:
+        print(f"--- message to {chat_id} ---\n{text}\n", flush=True)
+
+async def dry_run() -> None:
+    """Runs one full check through the normal pipeline and prints the report.
+
+    The check runs against an in-memory copy of the database, so the statuses, history and
+    cooldowns it records are thrown away afterwards.
+    """
+    global store
+    snapshot = Store(":memory:")
+    store.conn.backup(snapshot.conn)
+    real_store, store = store, snapshot
+    try:
+        context = SimpleNamespace(bot=DryRunBot())
+        chat_ids = get_notify_chat_ids() or [0]
+        logger.info(f"Dry run: checking {len(store.list_domains(enabled_only=True))} domains.")
+        await full_check(context, chat_ids[0], verbose=True)
+    finally:
+        store = real_store
+        snapshot.close()
+
+# --- Health Checks ---
+# Set once Telegram accepted the token and the watchlist is loaded; cleared on shutdown.
+bot_ready = threading.Event()
+
+class HealthHandler(BaseHTTPRequestHandler):
+    """Serves /healthz (process is up) and /readyz (bot is ready) for liveness and readiness probes."""
+
+    def do_GET(self):
+        if self.path == "/healthz":
+            self._reply(200, "ok")
+        elif self.path == "/readyz":
+            if bot_ready.is_set(): self._reply(200, "ready")
+            else: self._reply(503, "not ready")
+        else:
+            self._reply(404, "not found")
+
+    def _reply(self, code: int, text: str):
+        body = f"{text}\n".encode()
+        self.send_response(code)
+        self.send_header("Content-Type", "text/plain; charset=utf-8")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, format, *args):
+        pass  # probes hit these every few seconds
+
+def start_health_server(port: int) -> None:
+    server = ThreadingHTTPServer(("", port), HealthHandler)
+    threading.Thread(target=server.serve_forever, name="health-server", daemon=True).start()
+
+# --- Status API ---
+def read_domain_statuses(domain: str | None = None) -> list[dict]:
+    """Reads the watchlist with last-known statuses over a fresh read-only connection.
+
+    The API runs in server threads, so it never touches the bot's own connection.
+    """
+    conn = sqlite3.connect(f"file:{DB_FILE}?mode=ro", uri=True)
+    conn.row_factory = sqlite3.Row
+    try:
+        where, params = ("WHERE domain = ?", (domain,)) if domain else ("", ())
+        rows = conn.execute(
+            f"SELECT domain, added_at, last_status, last_checked, enabled, priority FROM domains {where} "
+            "ORDER BY domain",
+            params,
+        ).fetchall()
+        tags = {}
+        for row in conn.execute("SELECT domain, tag FROM domain_tags ORDER BY tag"):
+            tags.setdefault(row["domain"], []).append(row["tag"])
+    finally:
+        conn.close()
+    return [
+        {
+            "domain": r["domain"],
+            "status": r["last_status"],
+            "blocked": None if r["last_status"] is None else r["last_status"] == "blocked",
+            "lastChecked": r["last_checked"],
+            "addedAt": r["added_at"],
+            "enabled": bool(r["enabled"]),
+            "priority": bool(r["priority"]),
+            "tags": tags.get(r["domain"], []),
+        }
+        for r in rows
+    ]
+
+class StatusAPIHandler(BaseHTTPRequestHandler):
+    """Serves GET /api/domains and /api/domains/<domain> as JSON to bearer-token holders."""
+
+    def do_GET(self):
+        expected = f"Bearer {STATUS_API_TOKEN}".encode()
+        if not secrets.compare_digest(self.headers.get("Authorization", "").encode(), expected):
+            self._reply(401, {"error": "unauthorized"})
+            return
+        path = self.path.split("?", 1)[0].rstrip("/")
+        try:
+            if path == "/api/domains":
+                self._reply(200, {"domains": read_domain_statuses()})
+            elif path.startswith("/api/domains/"):
+                matches = read_domain_statuses(path.removeprefix("/api/domains/").lower())
+                if matches: self._reply(200, matches[0])
+                else: self._reply(404, {"error": "domain not tracked"})
+            else:
+                self._reply(404, {"error": "not found"})
+        except sqlite3.Error as e:
+            logger.error(f"Status API read failed: {e}")
+            self._reply(503, {"error": "database unavailable"})
+
+    def _reply(self, code: int, payload: dict):
+        body = json.dumps(payload).encode()
+        self.send_response(code)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, format, *args):
+        logger.debug(f"Status API: {format % args}")
+
+def start_status_api(port: int) -> None:
+    server = ThreadingHTTPServer(("", port), StatusAPIHandler)
+    threading.Thread(target=server.serve_forever, name="status-api", daemon=True).start()
+
+# --- Startup Configuration ---
+# Parsed from BACKUP_KEEP, SMTP_PORT and the other whole-number settings by load_config().
+backup_keep = report_keep = expiry_warn_days = max_domains = 0
+smtp_port = 587
+problem_threshold = 3
+top_default_count = 10
+stats_points = 12
+
+class ConfigError(Exception):
+    """Raised by load_config with one line per problem found."""
+
+@dataclass
+class Config:
+    """Settings parsed from the environment that need validation beyond a plain lookup."""
+    expiry_check_interval: int = 86400
+    api_delay: float = 0.0
+    http_timeout: float = 10.0
+    check_deadline: float = 600.0
+    notify_cooldown: int = 0
+    result_cache_ttl: int = 60
+    quiet_hours: tuple[dt_time, dt_time] | None = None
+    dns_resolvers: dict[str, str] = field(default_factory=dict)
+    report_template: Template | None = None
+    admin_ids: set[int] = field(default_factory=set)
+    notifiers: list[str] = field(default_factory=lambda: ["telegram"])
+    viewer_ids: set[int] = field(default_factory=set)
+    backup_keep: int = 0
+    report_keep: int = 0
+    expiry_warn_days: int = 0
+    webhook_port: int = 8443
+    smtp_port: int = 587
+    max_domains: int = 0
+    problem_threshold: int = 3
+    top_default_count: int = 10
+    stats_points: int = 12
+    check_concurrency: int = 4
+    metrics_port: int | None = None
+    health_port: int | None = None
+    status_api_port: int | None = None
+
+def load_config() -> Config:
+    """Validates every setting and parses the ones that need it.
+
+    All problems are collected and raised together as a ConfigError, so a broken
+    deployment can be fixed in one go instead of one restart per mistake.
+    """
+    config, problems = Config(), []
+    if config_file_error: problems.append(config_file_error)
+    if not TELEGRAM_TOKEN and not DRY_RUN: problems.append("TELEGRAM_TOKEN is missing.")
+    if CHECK_BACKEND not in CHECKERS:
+        problems.append(f"CHECK_BACKEND '{CHECK_BACKEND}' is unknown, expected one of: {', '.join(CHECKERS)}.")
+    if CHECK_BACKEND == "indiwtf" and not INDIWTF_TOKEN: problems.append("INDIWTF_TOKEN is missing.")
+    api_url = urlparse(INDIWTF_API_BASE_URL)
+    if api_url.scheme not in ("http", "https") or not api_url.netloc:
+        problems.append(f"API_BASE_URL '{INDIWTF_API_BASE_URL}' is not an http(s) URL.")
+    if API_METHOD not in ("GET", "POST"): problems.append(f"API_METHOD '{API_METHOD}' must be GET or POST.")
+    if BOT_MODE not in ("polling", "webhook"):
+        problems.append(f"BOT_MODE '{BOT_MODE}' must be 'polling' or 'webhook'.")
+    if BOT_MODE == "webhook" and not WEBHOOK_URL: problems.append("BOT_MODE=webhook requires WEBHOOK_URL.")
+    try:
+        parse_schedule(CHECK_SCHEDULE)
+    except ValueError as e:
+        problems.append(f"CHECK_SCHEDULE: {e}")
+    for name, raw, attr in (
+        ("API_DELAY", API_DELAY, "api_delay"),
+        ("HTTP_TIMEOUT", HTTP_TIMEOUT, "http_timeout"),
+        ("CHECK_DEADLINE", CHECK_DEADLINE, "check_deadline"),
+    ):
+        try:
+            value = parse_delay(raw)
+        except ValueError as e:
+            problems.append(f"{name}: {e}")
+            continue
+        if value <= 0 and attr != "api_delay": problems.append(f"{name} must be positive.")
+        setattr(config, attr, value)
+    for name, raw, attr in (
+        ("NOTIFY_COOLDOWN", NOTIFY_COOLDOWN, "notify_cooldown"),
+        ("RESULT_CACHE_TTL", RESULT_CACHE_TTL, "result_cache_ttl"),
+    ):
+        value = parse_duration(raw)
+        if value is None: problems.append(f"{name} '{raw}' is not a duration like 6h or 60s.")
+        else: setattr(config, attr, value)
+    for name, raw, attr, minimum in (
+        ("BACKUP_KEEP", BACKUP_KEEP, "backup_keep", 0),
+        ("REPORT_KEEP", REPORT_KEEP, "report_keep", 0),
+        ("EXPIRY_WARN_DAYS", EXPIRY_WARN_DAYS, "expiry_warn_days", 0),
+        ("WEBHOOK_PORT", WEBHOOK_PORT, "webhook_port", 1),
+        ("SMTP_PORT", SMTP_PORT, "smtp_port", 1),
+        ("MAX_DOMAINS", MAX_DOMAINS, "max_domains", 0),
+        ("PROBLEM_THRESHOLD", PROBLEM_THRESHOLD, "problem_threshold", 1),
+        ("TOP_COUNT", TOP_DEFAULT_COUNT, "top_default_count", 1),
+        ("STATS_POINTS", STATS_POINTS, "stats_points", 1),
+        ("CHECK_CONCURRENCY", CHECK_CONCURRENCY, "check_concurrency", 1),
+        ("METRICS_PORT", METRICS_PORT, "metrics_port", 1),
+        ("HEALTH_PORT", HEALTH_PORT, "health_port", 1),
+        ("STATUS_API_PORT", STATUS_API_PORT, "status_api_port", 1),
+    ):
+        # The optional servers stay off while their port is unset.
+        if raw is None: continue
+        try:
+            value = int(raw.strip())
+        except ValueError:
+            problems.append(f"{name} '{raw}' must be a whole number.")
+            continue
+        if value < minimum: problems.append(f"{name} must be at least {minimum}.")
+        elif attr.endswith("_port") and value > 65535: problems.append(f"{name} {value} is not a valid port.")
+        else: setattr(config, attr, value)
+    if config.check_concurrency > MAX_CHECK_CONCURRENCY:
+        logger.warning(
+            f"CHECK_CONCURRENCY {config.check_concurrency} is above the ceiling, using {MAX_CHECK_CONCURRENCY}."
+        )
+        config.check_concurrency = MAX_CHECK_CONCURRENCY
+    if QUIET_HOURS:
+        try:
+            config.quiet_hours = parse_quiet_hours(QUIET_HOURS)
+        except ValueError as e:
+            problems.append(f"QUIET_HOURS: {e}")
+    try:
+        config.dns_resolvers = parse_resolvers(DNS_RESOLVERS)
+    except ValueError as e:
+        problems.append(f"DNS_RESOLVERS: {e}")
+    try:
+        config.report_template = load_report_template()
+    except ValueError as e:
+        problems.append(f"Report template: {e}")
+    if ADMIN_CHAT_ID is None:
+        logger.warning("ADMIN_CHAT_ID is unset: any chat can use the bot and /start picks the report chat.")
+    else:
+        try:
+            config.admin_ids = parse_admin_ids(ADMIN_CHAT_ID)
+        except ValueError as e:
+            problems.append(f"ADMIN_CHAT_ID: {e}")
+    if VIEWER_CHAT_IDS is not None:
+        if ADMIN_CHAT_ID is None:
+            problems.append("VIEWER_CHAT_IDS needs ADMIN_CHAT_ID; without admins every chat has full access.")
+        try:
+            config.viewer_ids = parse_admin_ids(VIEWER_CHAT_IDS) - config.admin_ids
+        except ValueError as e:
+            problems.append(f"VIEWER_CHAT_IDS: {e}")
+    if config.expiry_warn_days:
+        interval = parse_duration(EXPIRY_CHECK_INTERVAL)
+        if interval is None or interval < 3600:
+            problems.append(f"EXPIRY_CHECK_INTERVAL '{EXPIRY_CHECK_INTERVAL}' must be a duration of at least 1h.")
+        else:
+            config.expiry_check_interval = interval
+    try:
+        config.notifiers = parse_notifiers(NOTIFIER)
+    except ValueError as e:
+        problems.append(f"NOTIFIER: {e}")
+    if "slack" in config.notifiers and not SLACK_WEBHOOK_URL:
+        problems.append("NOTIFIER=slack requires SLACK_WEBHOOK_URL.")
+    if "email" in config.notifiers and not SMTP_HOST:
+        problems.append("NOTIFIER=email requires SMTP_HOST.")
+    if SMTP_HOST:
+        if not SMTP_FROM or not SMTP_TO: problems.append("SMTP_HOST requires SMTP_FROM and SMTP_TO.")
+        if SMTP_SECURITY not in ("starttls", "ssl", "none"):
+            problems.append(f"SMTP_SECURITY '{SMTP_SECURITY}' must be starttls, ssl or none.")
+    if STATUS_WEBHOOK_URL and urlparse(STATUS_WEBHOOK_URL).scheme not in ("http", "https"):
+        problems.append(f"STATUS_WEBHOOK_URL '{STATUS_WEBHOOK_URL}' is not an http(s) URL.")
+    if STATUS_API_PORT and not STATUS_API_TOKEN:
+        problems.append("STATUS_API_PORT requires STATUS_API_TOKEN; the API is never served without auth.")
+    if DIGEST_SCHEDULE:
+        try:
+            parse_schedule(DIGEST_SCHEDULE)
+        except ValueError as e:
+            problems.append(f"DIGEST_SCHEDULE: {e}")
+    if not parse_duration(DIGEST_WINDOW):
+        problems.append(f"DIGEST_WINDOW '{DIGEST_WINDOW}' is not a duration like 1d or 7d.")
+    if MESSAGE_THREAD_ID and not MESSAGE_THREAD_ID.isdigit():
+        problems.append(f"MESSAGE_THREAD_ID '{MESSAGE_THREAD_ID}' must be a numeric topic ID.")
+    if DOMAINS_DIR and not Path(DOMAINS_DIR).is_dir():
+        problems.append(f"DOMAINS_DIR '{DOMAINS_DIR}' is not a directory.")
+    if problems: raise ConfigError("\n".join(f"- {p}" for p in problems))
+    return config
+
+def apply_config(config: Config) -> None:
+    """Puts a validated Config into effect; used at startup and by /reload."""
+    global admin_ids, viewer_ids, dns_resolvers, http_timeout, check_deadline, notify_cooldown
+    global result_cache_ttl, report_template, quiet_hours, backup_keep, report_keep, expiry_warn_days
+    global smtp_port, max_domains, problem_threshold, top_default_count, stats_points, check_concurrency, api_session
+    api_rate_limiter.interval = config.api_delay
+    http_timeout, check_deadline = config.http_timeout, config.check_deadline
+    notify_cooldown, result_cache_ttl = config.notify_cooldown, config.result_cache_ttl
+    quiet_hours, dns_resolvers, report_template = config.quiet_hours, config.dns_resolvers, config.report_template
+    admin_ids, viewer_ids = config.admin_ids, config.viewer_ids
+    backup_keep, report_keep, expiry_warn_days = config.backup_keep, config.report_keep, config.expiry_warn_days
+    smtp_port, max_domains, problem_threshold = config.smtp_port, config.max_domains, config.problem_threshold
+    top_default_count, stats_points = config.top_default_count, config.stats_points
+    if config.check_concurrency != check_concurrency:
+        # The connection pool is sized to the number of workers.
+        check_concurrency = config.check_concurrency
+        api_session = build_api_session()
+
+def schedule_quiet_end(job_queue: JobQueue) -> None:
+    """(Re)registers the job that delivers held notifications when quiet hours end."""
+    for job in job_queue.get_jobs_by_name("quiet_hours_end"): job.schedule_removal()
+    if quiet_hours is None: return
+    # Deliver the held summary right as the window closes rather than at the next check.
+    end = quiet_hours[1].replace(tzinfo=get_display_timezone())
+    job_queue.run_daily(flush_quiet_held, time=end, name="quiet_hours_end")
+
+# --- Lifecycle Hooks ---
+async def post_init(application: Application) -> None:
+    # initialize() has already called getMe, so the token is known to be valid here.
+    bot_ready.set()
+
+async def post_stop(application: Application) -> None:
+    logger.info("shutting down gracefully")
+    bot_ready.clear()
+    if check_lock.locked():
+        logger.info("Waiting for the in-flight domain check to finish...")
+    async with check_lock:
+        pass
+    if webhook_tasks:
+        logger.info(f"Waiting for {len(webhook_tasks)} status webhook deliveries...")
+        await asyncio.wait(webhook_tasks, timeout=30)
+
+async def post_shutdown(application: Application) -> None:
+    store.close()
+    logger.info("Shutdown complete.")
+
+def with_telegram_proxy(builder: ApplicationBuilder, proxy: str | None) -> ApplicationBuilder:
+    """Routes both Bot API calls and getUpdates polling through proxy, if one is set."""
+    if not proxy: return builder
+    logger.info("Sending Telegram requests through TELEGRAM_PROXY.")
+    return builder.proxy(proxy).get_updates_proxy(proxy)
 
 
 def main() -> None:
     """Starts the bot."""
-    if not TELEGRAM_TOKEN or not INDIWTF_TOKEN:
-        logger.critical("Missing TELEGRAM_TOKEN or INDIWTF_TOKEN.")
+    global store, domain_lists, check_job, check_schedule, checker, started_at, notifiers, email_notifier
+    started_at = datetime.now(timezone.utc)
+    try:
+        config = load_config()
+    except ConfigError as e:
+        logger.critical(f"Invalid configuration:\n{e}")
         return
-    
+    checker = CHECKERS[CHECK_BACKEND]()
+    apply_config(config)
+    # A dry run prints what Telegram would get and leaves the other sinks alone.
+    if not DRY_RUN: notifiers = [NOTIFIERS[name]() for name in config.notifiers]
+    if SMTP_HOST and not DRY_RUN: email_notifier = EmailNotifier()
+    if admin_ids: logger.info(f"Authorized {len(admin_ids)} admin chats and {len(viewer_ids)} viewer chats.")
+
+    if config.metrics_port:
+        try:
+            start_http_server(config.metrics_port)
+        except OSError as e:
+            logger.critical(f"Could not start metrics server on METRICS_PORT {config.metrics_port}: {e}")
+            return
+        logger.info(f"Serving Prometheus metrics on :{config.metrics_port}/metrics")
+
+    if config.health_port and not DRY_RUN:
+        try:
+            start_health_server(config.health_port)
+        except OSError as e:
+            logger.critical(f"Could not start health server on HEALTH_PORT {config.health_port}: {e}")
+            return
+        logger.info(f"Serving health checks on :{config.health_port}/healthz and /readyz")
+
+    if config.status_api_port and not DRY_RUN:
+        try:
+            start_status_api(config.status_api_port)
+        except OSError as e:
+            logger.critical(f"Could not start status API on STATUS_API_PORT {config.status_api_port}: {e}")
+            return
+        logger.info(f"Serving the status API on :{config.status_api_port}/api/domains")
+
+    store = Store(DB_FILE)
+    store.migrate_legacy_files(DATA_FILE, STATUS_FILE)
+    if DOMAINS_DIR: domain_lists, _, _ = import_domain_lists(Path(DOMAINS_DIR))
+
+    if DRY_RUN:
+        asyncio.run(dry_run())
+        store.close()
+        return
+
     job_queue = JobQueue()
-    application = (
+    builder = (
         Application.builder()
         .token(TELEGRAM_TOKEN)
         .job_queue(job_queue)
-        .build()
+        .post_init(post_init)
+        .post_stop(post_stop)
+        .post_shutdown(post_shutdown)
     )
+    application = with_telegram_proxy(builder, TELEGRAM_PROXY).build()
 
+    application.add_handler(TypeHandler(Update, log_command), group=-2)
+    application.add_handler(TypeHandler(Update, authorize_update), group=-1)
     application.add_handler(CommandHandler("start", start_command))
+    application.add_handler(CommandHandler("whoami", whoami_command))
     application.add_handler(CommandHandler("add", add_command))
     application.add_handler(CommandHandler("remove", remove_command))
     application.add_handler(CommandHandler("list", list_command))
+    application.add_handler(CallbackQueryHandler(list_callback, pattern=r"^list:"))
+    application.add_handler(CommandHandler("enable", enable_command))
+    application.add_handler(CommandHandler("disable", disable_command))
+    application.add_handler(CommandHandler("clear", clear_command))
+    application.add_handler(CallbackQueryHandler(clear_callback, pattern=r"^clear:"))
+    application.add_handler(CallbackQueryHandler(remove_callback, pattern=r"^remove:"))
+    application.add_handler(CommandHandler("export", export_command))
+    application.add_handler(CommandHandler("backup", backup_command))
+    application.add_handler(CommandHandler("search", search_command))
     application.add_handler(CommandHandler("check", check_command))
+    application.add_handler(CommandHandler("dns", dns_command))
+    application.add_handler(CommandHandler("info", info_command))
+    application.add_handler(CommandHandler("debug", debug_command))
+    application.add_handler(CommandHandler("ping", ping_command))
     application.add_handler(CommandHandler("checknow", check_now_command))
+    application.add_handler(CommandHandler("recheck_blocked", recheck_blocked_command))
+    application.add_handler(CommandHandler("emailreport", email_report_command))
+    application.add_handler(CommandHandler("status", status_command))
+    application.add_handler(CommandHandler("uptime", uptime_command))
+    application.add_handler(CommandHandler("config", config_command))
+    application.add_handler(CommandHandler("reload", reload_command))
+    application.add_handler(CommandHandler("history", history_command))
+    application.add_handler(CommandHandler("diff", diff_command))
+    application.add_handler(CommandHandler("compare", compare_command))
+    application.add_handler(CommandHandler("problems", problems_command))
+    application.add_handler(CommandHandler("top", top_command))
+    application.add_handler(CommandHandler("stats", stats_command))
+    application.add_handler(CommandHandler("digest", digest_command))
+    application.add_handler(CommandHandler("pause", pause_command))
+    application.add_handler(CommandHandler("resume", resume_command))
+    application.add_handler(CommandHandler("setinterval", setinterval_command))
+    application.add_handler(CommandHandler("schedule", schedule_command))
+    application.add_handler(CommandHandler("import", import_command))
+    application.add_handler(MessageHandler(filters.Document.ALL, import_document))
     
-    application.job_queue.run_repeating(periodic_check, interval=PERIODIC_CHECK_INTERVAL, first=10)
+    check_schedule = stored_check_schedule()
+    if store.get_setting("paused", False):
+        logger.info("Scheduled checks are paused; use /resume to start them.")
+    else:
+        check_job = schedule_checks(application.job_queue, check_schedule)
+        logger.info(f"Scheduled domain checks with '{check_schedule}'.")
+
+    schedule_quiet_end(application.job_queue)
+    if expiry_warn_days:
+        application.job_queue.run_repeating(
+            expiry_check, interval=config.expiry_check_interval, first=60, name="expiry_check"
+        )
+    application.job_queue.run_repeating(due_check, interval=DUE_CHECK_INTERVAL, first=30, name="due_check")
+    if DIGEST_SCHEDULE:
+        digest_schedule = parse_schedule(DIGEST_SCHEDULE)
+        if isinstance(digest_schedule, int):
+            application.job_queue.run_repeating(digest_job, interval=digest_schedule, name="digest")
+        else:
+            application.job_queue.run_custom(digest_job, job_kwargs={"trigger": digest_schedule}, name="digest")
+    # Queued as a job so it runs once the scheduler has started and next run times are known.
+    application.job_queue.run_once(send_startup_message, when=1)
 
-    logger.info("Bot is starting up...")
-    application.run_polling()
+    logger.info(f"Bot is starting up in {BOT_MODE} mode...")
+    stop_signals = (signal.SIGINT, signal.SIGTERM)
+    if BOT_MODE == "webhook":
+        application.run_webhook(
+            listen=WEBHOOK_LISTEN,
+            port=config.webhook_port,
+            url_path=urlparse(WEBHOOK_URL).path.lstrip("/"),
+            webhook_url=WEBHOOK_URL,
+            secret_token=WEBHOOK_SECRET,
+            cert=WEBHOOK_CERT,
+            key=WEBHOOK_KEY,
+            stop_signals=stop_signals,
+        )
+    else:
+        application.run_polling(stop_signals=stop_signals)
 
 if __name__ == "__main__":
     main()
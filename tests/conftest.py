@@ -0,0 +1,85 @@
+import json
+import sys
+import threading
+import time
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from pathlib import Path
+from urllib.parse import parse_qs, urlparse
+
+import pytest
+
+sys.path.insert(0, str(Path(__file__).resolve().parent.parent))
+
+import bot  # noqa: E402
+
+
+class MockAPI:
+    """A local stand-in for the indiwtf API; responses are set per domain before each test."""
+
+    def __init__(self):
+        self.responses = {}  # domain -> (status code, body, delay in seconds)
+        self.requests = []  # (method, params) for every request received
+        handler = self._handler()
+        self.server = ThreadingHTTPServer(("127.0.0.1", 0), handler)
+        self.server.daemon_threads = True
+        self.server.block_on_close = False
+        self.url = f"http://127.0.0.1:{self.server.server_port}"
+
+    def respond(self, domain, body, status=200, delay=0):
+        if not isinstance(body, str): body = json.dumps(body)
+        self.responses[domain] = (status, body, delay)
+
+    def _handler(self):
+        api = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def _reply(self, params):
+                api.requests.append((self.command, params))
+                domain = params.get("domain", [""])[0]
+                status, body, delay = api.responses.get(domain, (404, '{"error": "unknown domain"}', 0))
+                if delay: time.sleep(delay)
+                payload = body.encode()
+                try:
+                    self.send_response(status)
+                    self.send_header("Content-Type", "application/json")
+                    self.send_header("Content-Length", str(len(payload)))
+                    self.end_headers()
+                    self.wfile.write(payload)
+                except (BrokenPipeError, ConnectionResetError):
+                    pass
+
+            def do_GET(self):
+                self._reply(parse_qs(urlparse(self.path).query))
+
+            def do_POST(self):
+                length = int(self.headers.get("Content-Length") or 0)
+                self._reply(parse_qs(self.rfile.read(length).decode()))
+
+            def log_message(self, *args):
+                pass
+
+        return Handler
+
+
+@pytest.fixture
+def api():
+    mock = MockAPI()
+    thread = threading.Thread(target=mock.server.serve_forever, daemon=True)
+    thread.start()
+    yield mock
+    mock.server.shutdown()
+    mock.server.server_close()
+
+
+@pytest.fixture(autouse=True)
+def no_retry_delay(monkeypatch):
+    monkeypatch.setattr(bot, "API_RETRY_BASE_DELAY", 0)
+    monkeypatch.setattr(bot.api_rate_limiter, "interval", 0)
+
+
+@pytest.fixture
+def store(tmp_path, monkeypatch):
+    db = bot.Store(tmp_path / "domains.db")
+    monkeypatch.setattr(bot, "store", db)
+    yield db
+    db.close()
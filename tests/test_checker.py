@@ -0,0 +1,129 @@
+import asyncio
+
+import bot
+from test_http import FakeResponse, FakeSession
+
+
+def check(api, domain, **kwargs):
+    checker = bot.IndiwtfChecker(base_url=api.url, token="secret", **kwargs)
+    return asyncio.run(checker.check_domain(domain))
+
+
+def test_blocked(api):
+    api.respond("blocked.com", {"domain": "blocked.com", "status": "BLOCKED", "reason": "trustpositif"})
+    result = check(api, "Blocked.com")
+    assert result["status"] == "blocked"
+    assert bot.format_status_message(result, "blocked.com") == "https://blocked.com/: ❌ Blocked (trustpositif)"
+    method, params = api.requests[0]
+    assert method == "GET"
+    assert params == {"domain": ["blocked.com"], "token": ["secret"]}
+
+
+def test_unblocked(api):
+    api.respond("ok.com", {"domain": "ok.com", "status": "allowed"})
+    result = check(api, "ok.com")
+    assert result == {"domain": "ok.com", "status": "allowed"}
+    assert bot.format_status_message(result, "ok.com") == "https://ok.com/: ✅ OK"
+
+
+def test_post_sends_form_body(api):
+    api.respond("ok.com", {"domain": "ok.com", "status": "allowed"})
+    assert check(api, "ok.com", method="POST")["status"] == "allowed"
+    assert api.requests == [("POST", {"domain": ["ok.com"], "token": ["secret"]})]
+
+
+def test_malformed_json_is_retried_then_reported(api):
+    api.respond("bad.com", "<html>oops</html>")
+    result = check(api, "bad.com")
+    assert "error" in result
+    assert len(api.requests) == 4
+    assert bot.format_status_message(result, "bad.com").startswith("❌ Error checking bad.com: ")
+
+
+def test_empty_json_is_an_error(api):
+    api.respond("empty.com", {})
+    assert check(api, "empty.com") == {"error": "empty API response, status unknown"}
+
+
+def test_server_error_is_retried(api):
+    api.respond("down.com", "upstream failed", status=502)
+    result = check(api, "down.com")
+    assert result == {"error": "HTTP 502: upstream failed"}
+    assert len(api.requests) == 4
+
+
+def test_client_error_is_not_retried(api):
+    api.respond("nope.com", "", status=403)
+    result = check(api, "nope.com")
+    assert result == {"error": "HTTP 403: (empty body)"}
+    assert len(api.requests) == 1
+    assert bot.format_status_message(result, "nope.com") == "❌ Error checking nope.com: HTTP 403: (empty body)"
+
+
+def test_timeout(api, monkeypatch):
+    monkeypatch.setattr(bot, "http_timeout", 0.2)
+    api.respond("slow.com", {"domain": "slow.com", "status": "allowed"}, delay=1)
+    result = check(api, "slow.com")
+    assert "error" in result
+    assert len(api.requests) == 4
+
+
+def test_missing_token_skips_request(api):
+    checker = bot.IndiwtfChecker(base_url=api.url, token="")
+    assert asyncio.run(checker.check_domain("ok.com")) == {"error": "Indiwtf API token is not configured."}
+    assert api.requests == []
+
+
+def test_report(api, store):
+    api.respond("blocked.com", {"domain": "blocked.com", "status": "blocked"})
+    api.respond("ok.com", {"domain": "ok.com", "status": "allowed"})
+    api.respond("nope.com", "denied", status=401)
+    checker = bot.IndiwtfChecker(base_url=api.url, token="secret")
+    results = asyncio.run(checker.check(["blocked.com", "ok.com", "nope.com"]))
+    assert bot.format_report(results) == "\n".join([
+        "Domain Check Results\n",
+        "🚫 Blocked (1)",
+        "https://blocked.com/: ❌ Blocked",
+        "\n✅ Clear (1)",
+        "\n⚠️ Errors (1)",
+        "❌ Error checking nope.com: HTTP 401: denied",
+        "\nUse /checknow verbose to list clear domains.",
+    ])
+    assert "https://ok.com/: ✅ OK" in bot.format_report(results, verbose=True)
+
+
+def test_debug_url_follows_method(api):
+    api.respond("ok.com", {"domain": "ok.com", "status": "allowed", "echo": "secret"})
+    checker = bot.IndiwtfChecker(base_url=api.url, token="secret")
+    shown, status, body = asyncio.run(checker.fetch_raw("ok.com"))
+    assert shown == f"GET {api.url}/check?domain=ok.com&token=***"
+    assert status == 200 and "secret" not in body
+    shown, _, _ = asyncio.run(checker.fetch_raw("ok.com", "POST"))
+    assert shown == f"POST {api.url}/check (form: domain=ok.com&token=***)"
+    assert [method for method, _ in api.requests] == ["GET", "POST"]
+
+
+def test_post_falls_back_to_get_on_405(monkeypatch):
+    def respond(kwargs):
+        if "data" in kwargs: return FakeResponse(405, "method not allowed")
+        return FakeResponse(200, '{"domain": "ok.com", "status": "allowed"}')
+
+    session = FakeSession(respond)
+    monkeypatch.setattr(bot, "api_session", session)
+    checker = bot.IndiwtfChecker(base_url="http://api.test", token="secret", method="POST")
+    assert asyncio.run(checker.check_domain("ok.com"))["status"] == "allowed"
+    assert checker.method == "GET"
+    assert [method for method, *_ in session.calls] == ["POST", "GET"]
+
+
+def test_retry_backoff(api, monkeypatch):
+    delays = []
+
+    async def record_sleep(delay):
+        delays.append(delay)
+
+    monkeypatch.setattr(bot, "API_RETRY_BASE_DELAY", 1)
+    monkeypatch.setattr(bot.asyncio, "sleep", record_sleep)
+    api.respond("down.com", "upstream failed", status=503)
+    assert check(api, "down.com") == {"error": "HTTP 503: upstream failed"}
+    assert delays == [1, 2, 4]
@@ -0,0 +1,64 @@
+import pytest
+
+import bot
+
+
+@pytest.fixture
+def valid_env(monkeypatch):
+    monkeypatch.setattr(bot, "TELEGRAM_TOKEN", "123:abc")
+    monkeypatch.setattr(bot, "INDIWTF_TOKEN", "secret")
+    monkeypatch.setattr(bot, "config_file_error", None)
+
+
+def test_whole_number_settings_are_parsed(valid_env, monkeypatch):
+    monkeypatch.setattr(bot, "SMTP_PORT", " 2525 ")
+    monkeypatch.setattr(bot, "MAX_DOMAINS", "100")
+    config = bot.load_config()
+    assert (config.smtp_port, config.max_domains, config.problem_threshold) == (2525, 100, 3)
+
+
+def test_bad_whole_numbers_are_reported_together(valid_env, monkeypatch):
+    monkeypatch.setattr(bot, "MAX_DOMAINS", "lots")
+    monkeypatch.setattr(bot, "SMTP_PORT", "70000")
+    monkeypatch.setattr(bot, "PROBLEM_THRESHOLD", "0")
+    with pytest.raises(bot.ConfigError) as excinfo:
+        bot.load_config()
+    message = str(excinfo.value)
+    assert "MAX_DOMAINS 'lots' must be a whole number." in message
+    assert "SMTP_PORT 70000 is not a valid port." in message
+    assert "PROBLEM_THRESHOLD must be at least 1." in message
+
+
+def test_report_template_is_validated_without_store(valid_env, monkeypatch):
+    monkeypatch.setattr(bot, "store", None)
+    monkeypatch.setattr(bot, "REPORT_TEMPLATE", "$blocked_count blocked of $total")
+    config = bot.load_config()
+    assert config.report_template.substitute(bot.report_fields({})).startswith("0 blocked of 0")
+
+
+def test_report_template_unknown_field(valid_env, monkeypatch):
+    monkeypatch.setattr(bot, "store", None)
+    monkeypatch.setattr(bot, "REPORT_TEMPLATE", "$nope")
+    with pytest.raises(bot.ConfigError, match=r"Report template: unknown field \$nope"):
+        bot.load_config()
+
+
+def test_ports_and_concurrency_are_reported_together(valid_env, monkeypatch):
+    monkeypatch.setattr(bot, "METRICS_PORT", "metrics")
+    monkeypatch.setattr(bot, "HEALTH_PORT", "0")
+    monkeypatch.setattr(bot, "CHECK_CONCURRENCY", "four")
+    with pytest.raises(bot.ConfigError) as excinfo:
+        bot.load_config()
+    message = str(excinfo.value)
+    assert "METRICS_PORT 'metrics' must be a whole number." in message
+    assert "HEALTH_PORT must be at least 1." in message
+    assert "CHECK_CONCURRENCY 'four' must be a whole number." in message
+
+
+def test_optional_ports_and_concurrency_ceiling(valid_env, monkeypatch):
+    monkeypatch.setattr(bot, "STATUS_API_PORT", "8081")
+    monkeypatch.setattr(bot, "STATUS_API_TOKEN", "token")
+    monkeypatch.setattr(bot, "CHECK_CONCURRENCY", "100")
+    config = bot.load_config()
+    assert (config.metrics_port, config.status_api_port) == (None, 8081)
+    assert config.check_concurrency == bot.MAX_CHECK_CONCURRENCY
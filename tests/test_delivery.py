@@ -0,0 +1,60 @@
+import asyncio
+
+import bot
+from telegram.error import BadRequest, Forbidden, TimedOut
+
+
+class FlakyBot:
+    """Fails sends to the chats in errors with the given exception, and can queue a message mid-send."""
+
+    def __init__(self, errors=None, on_send=None):
+        self.errors = errors or {}
+        self.on_send = on_send
+        self.sent = []
+
+    async def send_message(self, chat_id, text, **kwargs):
+        if self.on_send: self.on_send()
+        if chat_id in self.errors: raise self.errors[chat_id]
+        self.sent.append((chat_id, text))
+
+
+class FakeContext:
+    def __init__(self, bot):
+        self.bot = bot
+
+
+def no_delays(monkeypatch):
+    monkeypatch.setattr(bot, "SEND_RETRY_BASE_DELAY", 0)
+    monkeypatch.setattr(bot, "send_rate_limiter", bot.ChatRateLimiter(0, 1000))
+
+
+def test_only_retryable_failures_are_queued(store, monkeypatch):
+    no_delays(monkeypatch)
+    monkeypatch.setattr(bot, "get_notify_chat_ids", lambda: [1, 2, 3, 4])
+    fake = FlakyBot({2: BadRequest("chat not found"), 3: Forbidden("bot was blocked"), 4: TimedOut("timed out")})
+    asyncio.run(bot.TelegramNotifier().send(FakeContext(fake), "hello"))
+    assert fake.sent == [(1, "hello")]
+    assert store.get_setting("undelivered") == [{"chat_id": 4, "text": "hello"}]
+
+
+def test_flush_keeps_messages_queued_meanwhile(store, monkeypatch):
+    no_delays(monkeypatch)
+    store.set_setting("undelivered", [{"chat_id": 1, "text": "old"}, {"chat_id": 2, "text": "still down"}])
+    queued = []
+
+    def queue_once():
+        if not queued:
+            queued.append(True)
+            bot.queue_undelivered(3, ["new"])
+
+    fake = FlakyBot({2: TimedOut("timed out")}, on_send=queue_once)
+    asyncio.run(bot.flush_undelivered(FakeContext(fake)))
+    assert fake.sent == [(1, "old")]
+    assert store.get_setting("undelivered") == [{"chat_id": 2, "text": "still down"}, {"chat_id": 3, "text": "new"}]
+
+
+def test_flush_drops_undeliverable_messages(store, monkeypatch):
+    no_delays(monkeypatch)
+    store.set_setting("undelivered", [{"chat_id": 2, "text": "gone"}])
+    asyncio.run(bot.flush_undelivered(FakeContext(FlakyBot({2: Forbidden("bot was blocked")}))))
+    assert store.get_setting("undelivered") == []
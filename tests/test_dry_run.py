@@ -0,0 +1,26 @@
+import asyncio
+
+import bot
+
+
+def test_dry_run_keeps_nothing(api, store, monkeypatch, capsys):
+    store.add_domains(["a.com"])
+    store.update_statuses({"a.com": {"status": "allowed"}}, "2026-01-01T00:00:00+00:00")
+    api.respond("a.com", {"domain": "a.com", "status": "blocked"})
+    posted = []
+
+    async def record_posts(events):
+        posted.extend(events)
+
+    monkeypatch.setattr(bot, "checker", bot.IndiwtfChecker(base_url=api.url, token="secret"))
+    monkeypatch.setattr(bot, "result_cache", {})
+    monkeypatch.setattr(bot, "DRY_RUN", True)
+    monkeypatch.setattr(bot, "STATUS_WEBHOOK_URL", "http://hooks.test/status")
+    monkeypatch.setattr(bot, "post_status_events", record_posts)
+    asyncio.run(bot.dry_run())
+    assert "https://a.com/: ❌ Blocked" in capsys.readouterr().out
+    assert bot.store is store
+    assert store.get_statuses() == {"a.com": False}
+    assert store.get_history("a.com", 10)[0]["status"] == "allowed"
+    assert store.get_setting("last_check") is None
+    assert posted == []
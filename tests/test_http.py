@@ -0,0 +1,64 @@
+import asyncio
+
+import bot
+
+
+class FakeResponse:
+    def __init__(self, status_code, text, fail_read=False):
+        self.status_code = status_code
+        self._text = text
+        self.fail_read = fail_read
+        self.closed = False
+
+    @property
+    def text(self):
+        if self.fail_read: raise bot.requests.ConnectionError("connection reset while reading body")
+        return self._text
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.close()
+
+    def close(self):
+        self.closed = True
+
+
+class FakeSession:
+    """Records every request and the response handed back for it."""
+
+    def __init__(self, make_response):
+        self.make_response = make_response
+        self.calls = []  # (method, url, kwargs, response)
+
+    def request(self, method, url, **kwargs):
+        response = self.make_response(kwargs)
+        self.calls.append((method, url, kwargs, response))
+        return response
+
+
+def ok_response(kwargs):
+    domain = (kwargs.get("params") or kwargs.get("data"))["domain"]
+    return FakeResponse(200, f'{{"domain": "{domain}", "status": "allowed"}}')
+
+
+def test_each_response_is_released(monkeypatch):
+    session = FakeSession(ok_response)
+    monkeypatch.setattr(bot, "api_session", session)
+    checker = bot.IndiwtfChecker(base_url="http://api.test", token="secret")
+    domains = [f"site{i}.com" for i in range(10)]
+    results = asyncio.run(checker.check(domains))
+    assert all(results[d]["status"] == "allowed" for d in domains)
+    assert len(session.calls) == len(domains)
+    assert all(response.closed for *_, response in session.calls)
+
+
+def test_response_is_released_when_reading_fails(monkeypatch):
+    session = FakeSession(lambda kwargs: FakeResponse(200, "", fail_read=True))
+    monkeypatch.setattr(bot, "api_session", session)
+    checker = bot.IndiwtfChecker(base_url="http://api.test", token="secret")
+    result = asyncio.run(checker.check_domain("site.com"))
+    assert result == {"error": "connection reset while reading body"}
+    assert len(session.calls) == 4
+    assert all(response.closed for *_, response in session.calls)
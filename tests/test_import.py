@@ -0,0 +1,45 @@
+import bot
+
+
+def test_crlf_list_file(tmp_path, store):
+    (tmp_path / "shops.txt").write_bytes(b"# shops\r\n Example.COM \r\nfoo.org\r\n\r\nfoo.org\r\n")
+    assert bot.import_domain_lists(tmp_path) == (["shops"], ["example.com", "foo.org"], [])
+    assert store.list_domains() == ["example.com", "foo.org"]
+    assert store.get_tags() == {"example.com": ["#shops"], "foo.org": ["#shops"]}
+    assert store.remove_domains(["example.com"]) == ["example.com"]
+    assert store.list_domains() == ["foo.org"]
+
+
+def test_parse_import_file_trims_crlf():
+    content = "domain,status\r\nA.com,BLOCKED\r\n  b.com  \r\n# note\r\n"
+    assert bot.parse_import_file(content) == ["a.com", "b.com"]
+
+
+def test_resync_removes_and_untags_dropped_domains(tmp_path, store):
+    (tmp_path / "shops.txt").write_text("a.com\nb.com\nshared.com\n")
+    (tmp_path / "news.txt").write_text("shared.com\nn.com\n")
+    bot.import_domain_lists(tmp_path)
+    store.add_tags(["b.com"], ["#vip"])
+    (tmp_path / "shops.txt").write_text("a.com\nc.com\n")
+    (tmp_path / "news.txt").unlink()
+    names, added, removed = bot.import_domain_lists(tmp_path)
+    assert (names, added, removed) == (["shops"], ["c.com"], ["n.com", "shared.com"])
+    assert store.list_domains() == ["a.com", "b.com", "c.com"]
+    assert store.get_tags() == {"a.com": ["#shops"], "b.com": ["#vip"], "c.com": ["#shops"]}
+
+
+def test_unreadable_list_is_left_alone(tmp_path, store):
+    (tmp_path / "shops.txt").write_text("a.com\n")
+    bot.import_domain_lists(tmp_path)
+    (tmp_path / "shops.txt").write_bytes(b"\xff\xfe")
+    assert bot.import_domain_lists(tmp_path) == ([], [], [])
+    assert store.get_tags() == {"a.com": ["#shops"]}
+
+
+def test_duplicates_are_removed_from_the_file(tmp_path, store):
+    path = tmp_path / "shops.txt"
+    path.write_text("# shops\na.com\nb.com, A.com\nhttps://b.com/  # again\nbad_entry\nc.com\n")
+    assert bot.import_domain_lists(tmp_path) == (["shops"], ["a.com", "b.com", "c.com"], [])
+    assert path.read_text() == "# shops\na.com\nb.com\nbad_entry\nc.com\n"
+    bot.import_domain_lists(tmp_path)
+    assert path.read_text() == "# shops\na.com\nb.com\nbad_entry\nc.com\n"
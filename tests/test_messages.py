@@ -0,0 +1,146 @@
+import asyncio
+from types import SimpleNamespace
+
+import pytest
+
+import bot
+
+
+class FakeBot:
+    def __init__(self):
+        self.sent = []
+
+    async def send_message(self, **kwargs):
+        self.sent.append(kwargs)
+
+
+def test_markdown_characters_are_rejected_as_domains():
+    for raw in ("my_site.com", "my*site.com", "*_*.com"):
+        with pytest.raises(ValueError):
+            bot.validate_domain(raw)
+
+
+def test_markdown_characters_are_sent_verbatim():
+    result = {"domain": "my_site*x.com", "status": "blocked", "reason": "under_review *now*"}
+    text = bot.format_status_message(result, "my_site*x.com")
+    assert text == "https://my_site*x.com/: ❌ Blocked (under_review *now*)"
+    fake = FakeBot()
+    asyncio.run(bot.send_with_retry(fake, 1, text))
+    assert fake.sent == [{"chat_id": 1, "text": text, "message_thread_id": None}]
+
+
+class FakeMessage:
+    message_thread_id = None
+    is_topic_message = False
+
+    def __init__(self, text=""):
+        self.text = text
+        self.replies = []
+
+    async def reply_text(self, text, **kwargs):
+        self.replies.append((text, kwargs))
+
+
+class FakeChat:
+    id = 1
+
+
+class FakeUpdate:
+    def __init__(self, text=""):
+        self.message = self.effective_message = FakeMessage(text)
+        self.effective_chat = FakeChat()
+
+
+def test_start_help_is_valid_markdown(store):
+    update = FakeUpdate("/start")
+    asyncio.run(bot.start_command(update, None))
+    [(text, kwargs)] = update.message.replies
+    assert kwargs == {"parse_mode": "Markdown"}
+    # Outside `code` spans, legacy Markdown fails on any unpaired * or _.
+    prose = "".join(text.split("`")[::2])
+    assert prose.count("*") % 2 == 0
+    assert "_" not in prose
+    assert "`*`" in text
+
+
+class FakeContext:
+    def __init__(self, args):
+        self.args = args
+
+
+def test_compare_escapes_table(store, monkeypatch):
+    monkeypatch.setattr(bot, "TZ_DISPLAY", "America/New_York")
+    store.add_domains(["a.com", "b.com"])
+    store.update_statuses({"a.com": {"status": "blocked"}, "b.com": {"status": "allowed"}}, "2026-01-01T00:00:00+00:00")
+    store.update_statuses({"a.com": {"status": "allowed"}}, "2026-01-02T00:00:00+00:00")
+    update = FakeUpdate("/compare a.com b.com")
+    asyncio.run(bot.compare_command(update, FakeContext(["a.com", "b.com"])))
+    [(text, kwargs)] = update.message.replies
+    assert kwargs == {"parse_mode": "HTML"}
+    assert text.startswith("🔀 Status timelines (America/New_York), * marks a change\n<pre>")
+    assert "BLOCKED*" in text
+    assert text.endswith("</pre>")
+    monkeypatch.setattr(bot, "USE_EMOJI", False)
+    update = FakeUpdate("/compare a.com b.com")
+    asyncio.run(bot.compare_command(update, FakeContext(["a.com", "b.com"])))
+    [(text, _)] = update.message.replies
+    assert text.startswith("Status timelines (America/New_York), * marks a change\n<pre>")
+
+
+def test_command_replies_follow_use_emoji(store, monkeypatch):
+    monkeypatch.setattr(bot, "USE_EMOJI", False)
+    store.add_domains(["a.com"])
+    store.update_statuses({"a.com": {"status": "blocked"}}, "2026-01-01T00:00:00+00:00")
+    update = FakeUpdate("/history a.com")
+    asyncio.run(bot.history_command(update, FakeContext(["a.com"])))
+    update.message.text = "/config"
+    asyncio.run(bot.config_command(update, FakeContext([])))
+    [(history, _), (config, _)] = update.message.replies
+    assert history.startswith("History for a.com\n")
+    assert config.startswith("Effective configuration\n")
+
+
+def test_list_markers_follow_use_emoji(store, monkeypatch):
+    store.add_domains(["a.com", "1.2.3.4"])
+    store.set_priority(["a.com"], True)
+    store.set_enabled(["a.com"], False)
+    store.set_interval(["a.com"], 300)
+    text, _ = bot.render_list_page(None, False, 0)
+    assert "⭐ priority ⏸️ disabled ⏱️ every 5m" in text and "🔢 IP, not checked" in text
+    monkeypatch.setattr(bot, "USE_EMOJI", False)
+    text, _ = bot.render_list_page(None, False, 0)
+    assert text.startswith("Current Watchlist:\n")
+    assert "priority disabled every 5m" in text and "IP, not checked" in text
+    assert not any(icon in text for icon in ("📋", "⭐", "🔢", "⏸️", "⏱️"))
+
+
+def test_startup_message_follows_use_emoji(store, monkeypatch):
+    sent = []
+
+    class RecordingNotifier(bot.Notifier):
+        async def send(self, context, text):
+            sent.append(text)
+
+    monkeypatch.setattr(bot, "notifiers", [RecordingNotifier()])
+    monkeypatch.setattr(bot, "check_job", None)
+    monkeypatch.setattr(bot, "USE_EMOJI", False)
+    asyncio.run(bot.send_startup_message(None))
+    assert sent == ["Bot started.\nWatching 0 domains.\nScheduled checks are paused."]
+
+
+class TopicMessage(FakeMessage):
+    message_thread_id = 42
+    is_topic_message = True
+
+
+def test_long_replies_stay_in_the_forum_topic(monkeypatch):
+    monkeypatch.setattr(bot, "send_rate_limiter", bot.ChatRateLimiter(0, 1000))
+    update = FakeUpdate("/problems")
+    update.message = update.effective_message = TopicMessage("/problems")
+    fake = FakeBot()
+    asyncio.run(bot.reply_long(update, SimpleNamespace(bot=fake), "x" * 5000))
+    assert [m["message_thread_id"] for m in fake.sent] == [42, 42]
+    update.message.is_topic_message = False
+    fake.sent.clear()
+    asyncio.run(bot.reply_long(update, SimpleNamespace(bot=fake), "short"))
+    assert fake.sent == [{"chat_id": 1, "text": "short", "message_thread_id": None}]
@@ -0,0 +1,34 @@
+import bot
+from test_http import FakeSession, ok_response
+
+
+def test_api_proxy_is_passed_per_request(monkeypatch):
+    session = FakeSession(ok_response)
+    monkeypatch.setattr(bot, "api_session", session)
+    monkeypatch.setattr(bot, "api_proxies", bot.proxy_map("socks5://proxy:1080"))
+    bot.http_request("GET", "http://api.test/check", {"domain": "a.com", "token": "secret"})
+    assert session.calls[0][2]["proxies"] == {"http": "socks5://proxy:1080", "https": "socks5://proxy:1080"}
+
+
+def test_no_api_proxy_leaves_environment_proxies():
+    assert bot.proxy_map(None) is None
+    assert bot.proxy_map("") is None
+
+
+class FakeBuilder:
+    def __init__(self):
+        self.proxies = {}
+
+    def proxy(self, url):
+        self.proxies["proxy"] = url
+        return self
+
+    def get_updates_proxy(self, url):
+        self.proxies["get_updates_proxy"] = url
+        return self
+
+
+def test_telegram_proxy_covers_requests_and_polling():
+    builder = bot.with_telegram_proxy(FakeBuilder(), "http://proxy:3128")
+    assert builder.proxies == {"proxy": "http://proxy:3128", "get_updates_proxy": "http://proxy:3128"}
+    assert bot.with_telegram_proxy(FakeBuilder(), None).proxies == {}
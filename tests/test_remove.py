@@ -0,0 +1,49 @@
+import asyncio
+from types import SimpleNamespace
+
+import bot
+from test_messages import FakeBot, FakeUpdate
+
+
+class FakeQuery:
+    def __init__(self, data):
+        self.data = data
+        self.answers = []
+        self.edits = []
+
+    async def answer(self, text=None):
+        self.answers.append(text)
+
+    async def edit_message_text(self, text, **kwargs):
+        self.edits.append(text)
+
+
+def remove(text):
+    update = FakeUpdate(text)
+    update.effective_user = SimpleNamespace(id=7)
+    context = SimpleNamespace(bot=FakeBot(), args=text.split()[1:])
+    asyncio.run(bot.remove_command(update, context))
+    return update, context
+
+
+def test_substring_removal_names_the_domain(store, monkeypatch):
+    monkeypatch.setattr(bot, "send_rate_limiter", bot.ChatRateLimiter(0, 1000))
+    store.add_domains(["example.com", "other.org"])
+    _, context = remove("/remove exampl")
+    assert context.bot.sent[0]["text"] == "Bulk Remove Report\n\n✅ Removed 1 domains: example.com"
+    assert store.list_domains() == ["other.org"]
+
+
+def test_remove_prompt_expires(store, monkeypatch):
+    monkeypatch.setattr(bot, "pending_removals", {})
+    store.add_domains(["shop-a.com", "shop-b.com"])
+    update, _ = remove("/remove shop")
+    [token] = bot.pending_removals
+    user, shown, created = bot.pending_removals[token]
+    bot.pending_removals[token] = (user, shown, created - bot.REMOVE_PROMPT_TTL - 1)
+    query = FakeQuery(f"remove:{token}:0")
+    callback = SimpleNamespace(callback_query=query, effective_user=SimpleNamespace(id=7))
+    asyncio.run(bot.remove_callback(callback, None))
+    assert query.edits == ["⌛ Selection expired. Send /remove again if needed."]
+    assert store.list_domains() == ["shop-a.com", "shop-b.com"]
+    assert bot.pending_removals == {}
@@ -0,0 +1,59 @@
+import asyncio
+from types import SimpleNamespace
+
+import bot
+
+
+class RecordingNotifier(bot.Notifier):
+    def __init__(self):
+        self.sent = []
+
+    async def send(self, context, text):
+        self.sent.append(text)
+
+
+def setup_checks(api, monkeypatch):
+    notifier = RecordingNotifier()
+    monkeypatch.setattr(bot, "notifiers", [notifier])
+    monkeypatch.setattr(bot, "checker", bot.IndiwtfChecker(base_url=api.url, token="secret"))
+    monkeypatch.setattr(bot, "result_cache", {})
+    monkeypatch.setattr(bot, "api_outage_alerted", False)
+    return notifier
+
+
+def test_failing_interval_domain_waits_its_interval(api, store, monkeypatch):
+    notifier = setup_checks(api, monkeypatch)
+    store.add_domains(["bad.com"])
+    store.set_interval(["bad.com"], 3600)
+    api.respond("bad.com", "invalid domain", status=400)
+    context = SimpleNamespace(bot=None)
+    asyncio.run(bot.due_check(context))
+    asyncio.run(bot.due_check(context))
+    assert len(api.requests) == 1
+    assert [row["domain"] for row in store.list_problems(1)] == ["bad.com"]
+    assert notifier.sent == []
+
+
+def test_scheduled_outage_still_counts_attempts(api, store, monkeypatch):
+    notifier = setup_checks(api, monkeypatch)
+    domains = ["a.com", "b.com", "c.com"]
+    store.add_domains(domains)
+    for domain in domains: api.respond(domain, "down", status=403)
+    asyncio.run(bot.scheduled_check(SimpleNamespace(bot=None), domains, "scheduled"))
+    assert notifier.sent == ["🚨 API unreachable, check skipped"]
+    assert [row["domain"] for row in store.list_problems(1)] == domains
+    assert store.get_setting("last_check") is None
+
+
+def test_only_global_runs_save_reports(api, store, monkeypatch, tmp_path):
+    setup_checks(api, monkeypatch)
+    monkeypatch.setattr(bot, "REPORT_DIR", tmp_path)
+    monkeypatch.setattr(bot, "report_keep", 5)
+    store.add_domains(["a.com"])
+    api.respond("a.com", {"domain": "a.com", "status": "allowed"})
+    context = SimpleNamespace(bot=None)
+    asyncio.run(bot.scheduled_check(context, ["a.com"], "interval"))
+    assert list(tmp_path.glob("report-*.txt")) == []
+    asyncio.run(bot.scheduled_check(context, ["a.com"], "scheduled"))
+    [report] = tmp_path.glob("report-*.txt")
+    assert report.read_text().startswith("scheduled check at ")
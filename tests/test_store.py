@@ -0,0 +1,32 @@
+from datetime import datetime, timedelta, timezone
+
+import bot
+
+
+def test_failed_check_counts_as_attempt(store):
+    store.add_domains(["a.com", "b.com"])
+    store.set_interval(["a.com", "b.com"], 3600)
+    now = datetime(2026, 1, 1, tzinfo=timezone.utc)
+    assert store.list_due_domains(now) == ["a.com", "b.com"]
+    store.update_statuses({"a.com": {"error": "HTTP 502: bad gateway"}, "b.com": {"status": "allowed"}}, now.isoformat())
+    assert store.list_due_domains(now + timedelta(minutes=10)) == []
+    assert store.list_due_domains(now + timedelta(hours=1)) == ["a.com", "b.com"]
+    assert store.list_problems(1)[0]["domain"] == "a.com"
+
+
+def test_schedule_override_survives_restart(store, monkeypatch):
+    monkeypatch.setattr(bot, "CHECK_SCHEDULE", "30m")
+    monkeypatch.setattr(bot, "check_job", None)
+    monkeypatch.setattr(bot, "check_schedule", "30m")
+    bot.reschedule(None, "5m")
+    assert bot.stored_check_schedule() == "5m"
+
+
+def test_schedule_override_dropped_when_base_changes(store, monkeypatch):
+    monkeypatch.setattr(bot, "CHECK_SCHEDULE", "30m")
+    monkeypatch.setattr(bot, "check_job", None)
+    monkeypatch.setattr(bot, "check_schedule", "30m")
+    bot.reschedule(None, "5m")
+    monkeypatch.setattr(bot, "CHECK_SCHEDULE", "1h")
+    assert bot.stored_check_schedule() == "1h"
+    assert store.get_setting("check_schedule") is None